@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SSH agent forwarding (auth-agent-req@openssh.com).
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Listener for the session's SSH_AUTH_SOCK.
+type agentForward struct {
+	dir      string
+	listener net.Listener
+}
+
+// Create a private socket for the session and relay every connection
+// to it over an auth-agent@openssh.com channel to the client.
+func (conn *ServerConn) startAgentForward() (*agentForward, error) {
+	dir, err := ioutil.TempDir("", "ssh-agent.")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	os.Chmod(sock, 0600)
+	af := &agentForward{dir: dir, listener: listener}
+	go af.serve(conn)
+	return af, nil
+}
+
+func (af *agentForward) serve(conn *ServerConn) {
+	for {
+		c, err := af.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			ch, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+			if err != nil {
+				dbg.Debug("Unable to open agent channel: %v", err)
+				return
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(ch, c)
+				ch.CloseWrite()
+			}()
+			io.Copy(c, ch)
+		}(c)
+	}
+}
+
+// Path for SSH_AUTH_SOCK.
+func (af *agentForward) path() string {
+	return af.listener.Addr().String()
+}
+
+// Stop listening and remove the socket.
+func (af *agentForward) close() {
+	af.listener.Close()
+	os.RemoveAll(af.dir)
+}
@@ -0,0 +1,318 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Algorithm configuration: `ciphers`, `kex_algorithms`, `macs`,
+// `hostkey_algorithms` and `pubkey_algorithms` list names separated by
+// spaces, commas or lines. Plain names replace the defaults, +name adds
+// to and -name removes from them, so legacy clients can be let in with
+// e.g. "+diffie-hellman-group14-sha1 +hmac-sha1".
+//
+// ssh-rsa is off for host keys: the ssh package signs with SHA-1 for them,
+// so an RSA host key needs "+ssh-rsa" in hostkey_algorithms. For client
+// keys it names the key type, which the client may still sign for with
+// rsa-sha2-256 or rsa-sha2-512, so it stays.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+var ErrAlgorithm = errors.New("Algorithm not allowed by the configuration.")
+
+type algorithmSetting struct {
+	file      string
+	supported []string // as in the vendored x/crypto/ssh, see algorithms_test.go
+	defaults  []string
+}
+
+var (
+	cipherSetting = &algorithmSetting{
+		file: "ciphers",
+		supported: []string{
+			"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+			"arcfour256", "arcfour128", "arcfour", "aes128-cbc", "3des-cbc",
+		},
+		defaults: []string{
+			"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+		},
+	}
+	kexSetting = &algorithmSetting{
+		file: "kex_algorithms",
+		supported: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		},
+		defaults: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		},
+	}
+	macSetting = &algorithmSetting{
+		file: "macs",
+		supported: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+		},
+		defaults: []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+	}
+	hostKeySetting = &algorithmSetting{
+		file: "hostkey_algorithms",
+		supported: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+		},
+		defaults: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		},
+	}
+	pubkeySetting = &algorithmSetting{
+		file: "pubkey_algorithms",
+		supported: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+			ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01, ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01,
+		},
+		defaults: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSA,
+			ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01, ssh.CertAlgoRSAv01,
+		},
+	}
+	algorithmSettings = []*algorithmSetting{cipherSetting, kexSetting, macSetting, hostKeySetting, pubkeySetting}
+)
+
+// The configured list, or an error naming what the ssh package lacks.
+func (a *algorithmSetting) load() ([]string, error) {
+	data, err := conf.getBytes(a.file)
+	if err != nil {
+		return a.defaults, nil
+	}
+	var plain, add, remove []string
+	for _, name := range strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		list := &plain
+		switch name[0] {
+		case '+':
+			list, name = &add, name[1:]
+		case '-':
+			list, name = &remove, name[1:]
+		}
+		if !contains(a.supported, name) {
+			return nil, fmt.Errorf("%s: unsupported algorithm %q, choose from %s",
+				a.file, name, strings.Join(a.supported, ","))
+		}
+		*list = append(*list, name)
+	}
+	list := plain
+	if len(plain) == 0 {
+		list = append([]string{}, a.defaults...)
+	}
+	for _, name := range add {
+		if !contains(list, name) {
+			list = append(list, name)
+		}
+	}
+	result := list[:0]
+	for _, name := range list {
+		if !contains(remove, name) {
+			result = append(result, name)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s: no algorithm left", a.file)
+	}
+	return result, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the algorithm files to the server config.
+func (s *Server) configureAlgorithms() error {
+	lists := make([][]string, len(algorithmSettings))
+	for i, a := range algorithmSettings {
+		list, err := a.load()
+		if err != nil {
+			return err
+		}
+		lists[i] = list
+	}
+	s.ServerConfig.Ciphers = lists[0]
+	s.ServerConfig.KeyExchanges = lists[1]
+	s.ServerConfig.MACs = lists[2]
+	s.hostKeyAlgos = lists[3]
+	s.pubkeyAlgos = lists[4]
+	return nil
+}
+
+// Print the effective algorithms like sshd -T.
+func dumpAlgorithms(w io.Writer) error {
+	var out bytes.Buffer
+	for _, a := range algorithmSettings {
+		list, err := a.load()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "%s %s\n", strings.Replace(a.file, "_", "", -1), strings.Join(list, ","))
+	}
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// A KEXINIT, see RFC 4253 section 7.1.
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// The first KEXINIT sent one way, found in the still plain text stream.
+type kexInitStream struct {
+	buf  bytes.Buffer
+	init *kexInitMsg
+	done bool
+}
+
+const maxKexInitPrefix = 64 * 1024
+
+func (k *kexInitStream) add(b []byte) {
+	if !k.done && len(b) > 0 {
+		k.buf.Write(b)
+		k.parse()
+	}
+}
+
+func (k *kexInitStream) parse() {
+	data := k.buf.Bytes()
+	// Skip the lines before and including the version.
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			k.done = k.buf.Len() > maxKexInitPrefix
+			return
+		}
+		line := data[:i]
+		data = data[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+	if len(data) < 5 {
+		return
+	}
+	length := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	padding := int(data[4])
+	if length > maxKexInitPrefix || padding+1 > length {
+		k.done = true
+		return
+	}
+	if len(data) < 4+length {
+		return
+	}
+	k.done = true
+	msg := &kexInitMsg{}
+	if err := ssh.Unmarshal(data[5:4+length-padding], msg); err != nil {
+		dbg.Debug("Unable to parse KEXINIT: %v", err)
+		return
+	}
+	k.init = msg
+	k.buf = bytes.Buffer{}
+}
+
+// A connection keeping both KEXINITs, so we can tell what was negotiated.
+type kexInitConn struct {
+	net.Conn
+	mu     sync.Mutex
+	client kexInitStream
+	server kexInitStream
+}
+
+func (c *kexInitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.client.add(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *kexInitConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.server.add(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func firstCommon(client, server []string) string {
+	for _, c := range client {
+		if contains(server, c) {
+			return c
+		}
+	}
+	return "none"
+}
+
+// What the handshake settled on, by the rule of RFC 4253 section 7.1 the
+// ssh package follows: the first of the client's algorithms the server
+// offered too. AEAD ciphers negotiate a MAC as well but don't use it.
+func (c *kexInitConn) negotiated() string {
+	c.mu.Lock()
+	client, server := c.client.init, c.server.init
+	c.mu.Unlock()
+	if client == nil || server == nil {
+		return "unknown"
+	}
+	mac := func(client, server []string, cipher string) string {
+		if strings.Contains(cipher, "gcm") || strings.Contains(cipher, "poly1305") {
+			return "<implicit>"
+		}
+		return firstCommon(client, server)
+	}
+	c2s := firstCommon(client.CiphersClientServer, server.CiphersClientServer)
+	s2c := firstCommon(client.CiphersServerClient, server.CiphersServerClient)
+	return fmt.Sprintf("kex %s hostkey %s cipher %s/%s mac %s/%s",
+		firstCommon(client.KexAlgos, server.KexAlgos),
+		firstCommon(client.ServerHostKeyAlgos, server.ServerHostKeyAlgos),
+		c2s, s2c,
+		mac(client.MACsClientServer, server.MACsClientServer, c2s),
+		mac(client.MACsServerClient, server.MACsServerClient, s2c))
+}
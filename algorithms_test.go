@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+// Handshake over loopback with both sides limited to one algorithm.
+func handshakeWith(t *testing.T, setup func(c *ssh.Config)) error {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ssh.ServerConfig{NoClientAuth: true}
+	server.AddHostKey(signer)
+	setup(&server.Config)
+	client := &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	setup(&client.Config)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		sc, _, _, err := ssh.NewServerConn(c, server)
+		if err == nil {
+			sc.Close()
+		}
+		done <- err
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, _, _, err := ssh.NewClientConn(c, l.Addr().String(), client)
+	if err == nil {
+		cc.Close()
+	}
+	if serr := <-done; err == nil {
+		err = serr
+	}
+	return err
+}
+
+// The supported lists are copied from x/crypto/ssh; make an update of
+// it that drops or adds an algorithm show up here.
+func TestSupportedAlgorithms(t *testing.T) {
+	settings := []struct {
+		setting *algorithmSetting
+		set     func(c *ssh.Config, name string)
+		enabled func(c *ssh.Config) []string
+	}{
+		{cipherSetting, func(c *ssh.Config, name string) { c.Ciphers = []string{name} },
+			func(c *ssh.Config) []string { return c.Ciphers }},
+		{kexSetting, func(c *ssh.Config, name string) { c.KeyExchanges = []string{name} },
+			func(c *ssh.Config) []string { return c.KeyExchanges }},
+		{macSetting, func(c *ssh.Config, name string) {
+			c.MACs = []string{name}
+			// AEAD ciphers don't use the MAC.
+			c.Ciphers = []string{"aes128-ctr"}
+		}, func(c *ssh.Config) []string { return c.MACs }},
+	}
+	var defaults ssh.Config
+	defaults.SetDefaults()
+	for _, s := range settings {
+		for _, name := range s.setting.supported {
+			if err := handshakeWith(t, func(c *ssh.Config) { s.set(c, name) }); err != nil {
+				t.Errorf("%s: %s no longer works: %v", s.setting.file, name, err)
+			}
+		}
+		for _, name := range s.enabled(&defaults) {
+			if !contains(s.setting.supported, name) {
+				t.Errorf("%s: %s is missing from the supported list", s.setting.file, name)
+			}
+		}
+		for _, name := range s.setting.defaults {
+			if !contains(s.setting.supported, name) {
+				t.Errorf("%s: default %s is not supported", s.setting.file, name)
+			}
+		}
+	}
+}
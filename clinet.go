@@ -19,6 +19,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/google/shlex"
+	"github.com/hengwu0/sshdog/datagram"
 	"github.com/hengwu0/sshdog/proc"
 	"github.com/hengwu0/sshdog/pty"
 	"golang.org/x/crypto/ssh"
@@ -28,6 +29,7 @@ import (
 	"os/exec"
 	"os/user"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -38,13 +40,37 @@ type ServerConn struct {
 	*ssh.ServerConn
 	reqs  <-chan *ssh.Request
 	chans <-chan ssh.NewChannel
+
+	active           int64 // unix nanoseconds of the last channel traffic, atomic
+	sessionsDisabled int32 // no-more-sessions@openssh.com, atomic
+
+	sessLock sync.Mutex
+	sessions map[*Channel]bool
+
+	fwdLock        sync.Mutex
+	streamForwards map[string]*streamForward
+	tcpForwards    map[string]*tcpForward
 }
 
 type Channel struct {
+	conn       *ServerConn
 	pty        *pty.Pty
 	ch         ssh.Channel
 	environ    []string
+	authFile   string
 	exitStatus uint32
+	exe        *exec.Cmd
+	exited     chan struct{}
+	rows, cols uint16
+	persist    *persistSession
+	persistTo  string
+	watched    *watchedSession
+	watching   *watchedSession
+	watcher    string
+	cgroup     string
+	enterTo    string
+	agent      *agentForward
+	x11        *x11Forward
 }
 
 func NewServerConn(conn net.Conn, s *Server) (*ServerConn, error) {
@@ -62,13 +88,13 @@ func NewServerConn(conn net.Conn, s *Server) (*ServerConn, error) {
 	}, nil
 }
 
-func (conn *ServerConn) ServiceGlobalRequests() {
-	for r := range conn.reqs {
-		dbg.Debug("Received request %s plus %d bytes.", r.Type, len(r.Payload))
-		if r.WantReply {
-			r.Reply(true, []byte{})
-		}
+// The user authentication admitted, as the client's name alone could
+// pick another user's settings.
+func (conn *ServerConn) authUser() string {
+	if conn.Permissions == nil {
+		return ""
 	}
+	return conn.Permissions.Extensions[userExtension]
 }
 
 // Handle a single established connection
@@ -76,20 +102,39 @@ func (conn *ServerConn) HandleConn() {
 	defer func() {
 		dbg.Debug("Closing connection to: %s", conn.RemoteAddr())
 		conn.Close()
+		conn.closeTCPForwards()
+		conn.closeStreamForwards()
 	}()
 
+	done := make(chan struct{})
+	defer close(done)
 	go conn.ServiceGlobalRequests()
+	go conn.keepAlive(done)
+	conn.touch()
+	go conn.enforceLimits(done)
+	conn.announceHostKeys()
 	wg := &sync.WaitGroup{}
 
 	for newChan := range conn.chans {
 		dbg.Debug("Incoming channel request: %s: %p", newChan.ChannelType(), newChan)
 		switch newChan.ChannelType() {
 		case "session":
+			if !conn.sessionsAllowed() {
+				conn.audit("rejected session after no-more-sessions")
+				newChan.Reject(ssh.Prohibited, "No more sessions.")
+				continue
+			}
 			wg.Add(1)
 			go conn.HandleSessionChannel(wg, newChan)
 		case "direct-tcpip":
 			wg.Add(1)
 			go conn.HandleTCPIPChannel(wg, newChan)
+		case datagram.ChannelType:
+			wg.Add(1)
+			go conn.HandleUDPChannel(wg, newChan)
+		case "direct-streamlocal@openssh.com":
+			wg.Add(1)
+			go conn.HandleStreamLocalChannel(wg, newChan)
 		default:
 			dbg.Debug("Unable to handle channel request, rejecting.")
 			newChan.Reject(ssh.Prohibited, "Prohibited")
@@ -157,17 +202,39 @@ func (ch *Channel) Close() {
 		ch.ch.Close()
 		ch.ch = nil
 	}
+	if ch.authFile != "" {
+		os.Remove(ch.authFile)
+		ch.authFile = ""
+	}
+	if ch.agent != nil {
+		ch.agent.close()
+		ch.agent = nil
+	}
+	// Closing X11 may run xauth, so not under the lock.
+	x11 := ch.x11
+	ch.x11 = nil
 	lock.Unlock()
+	if x11 != nil {
+		x11.close()
+	}
 }
 
-// Execute a process for the channel.
-func (ch *Channel) ExecuteForChannel(shellCmd []string) {
-	dbg.Debug("Executing %v", shellCmd)
+// Build the process for the channel.
+func (ch *Channel) command(shellCmd []string) *exec.Cmd {
 	exe := exec.Command(shellCmd[0], shellCmd[1:]...)
 	exe.Env = ch.environ
-	if userInfo, err := user.Current(); err == nil {
+	if home := getEnv(ch.environ, "HOME"); home != "" {
+		exe.Dir = home
+	} else if userInfo, err := user.Current(); err == nil {
 		exe.Dir = userInfo.HomeDir
 	}
+	return exe
+}
+
+// Execute a process for the channel.
+func (ch *Channel) ExecuteForChannel(shellCmd []string) {
+	dbg.Debug("Executing %v", shellCmd)
+	exe := ch.command(shellCmd)
 	if ch.pty == nil {
 		stdin, _ := exe.StdinPipe()
 		go io.Copy(stdin, ch.ch)
@@ -177,64 +244,234 @@ func (ch *Channel) ExecuteForChannel(shellCmd []string) {
 		ch.pty.AttachTty(exe)
 		ch.pty.AttachIO(ch.ch, ch.ch)
 	}
+	proc.SetProcessGroup(exe)
+	cgroup, err := ch.confine(exe)
+	if err != nil {
+		dbg.Debug("Unable to confine session: %v", err)
+		if ch.pty != nil {
+			ch.pty.CloseTTY()
+		}
+		fmt.Fprintf(ch.ch.Stderr(), "sshdog: %v\r\n", err)
+		ch.exitStatus = 1
+		ch.Close()
+		return
+	}
+	ch.cgroup = cgroup
 
 	proc.Setuid(conf.fileExists("setuid"))
-	exe.Start()
+	err = exe.Start()
 	//detach shell
 	if ch.pty != nil {
 		ch.pty.CloseTTY()
 	}
+	if err != nil {
+		dbg.Debug("failed to start executing(%s)", err)
+		proc.RemoveCgroup(ch.cgroup)
+		ch.exitStatus = 127
+		ch.Close()
+		return
+	}
+	ch.exe = exe
+	ch.exited = make(chan struct{})
+	if ch.pty != nil {
+		ch.watched = ch.conn.registerWatched(ch.pty)
+	}
 	dbg.Debug("Executing...")
 	go func(exe *exec.Cmd, ch *Channel) {
-		if exe.Process != nil {
-			_, err := exe.Process.Wait()
-			if err != nil {
-				dbg.Debug("failed to exit executing(%s)", err)
-			}
+		if err := exe.Wait(); err != nil {
+			dbg.Debug("failed to exit executing(%s)", err)
+		}
+		close(ch.exited)
+		if ch.pty != nil && !ch.pty.WaitIO(time.Second) {
+			dbg.Debug("pty output not drained.")
+		}
+		if ch.watched != nil {
+			ch.watched.unregister()
 		}
 		ch.Close()
+		proc.RemoveCgroup(ch.cgroup)
 		dbg.Debug("Executied.")
 	}(exe, ch)
 }
 
-// parseDims extracts terminal dimensions (width x height) from the provided buffer.
-func parseDims(b []byte) (uint16, uint16) {
-	w := binary.BigEndian.Uint32(b)
-	h := binary.BigEndian.Uint32(b[4:])
-	return uint16(w), uint16(h)
+// Stop whatever still runs for the channel and release the pty.
+// The tree gets SIGHUP, then SIGKILL once `kill_timeout` seconds passed.
+func (ch *Channel) terminate() {
+	if ch.persist != nil {
+		ch.persist.detach(ch)
+		return
+	}
+	if ch.watching != nil {
+		ch.watching.leave(ch)
+		// The watcher's own pty from ssh -t, nothing runs on it.
+		if ch.pty != nil {
+			ch.pty.Close()
+		}
+		return
+	}
+	ch.stopProcess()
+	if ch.pty != nil {
+		ch.pty.Close()
+	}
+	if err := proc.RemoveCgroup(ch.cgroup); err != nil {
+		dbg.Debug("Unable to remove cgroup %s: %v", ch.cgroup, err)
+	}
 }
 
-func (ch *Channel) KeepAlive() {
-	for {
-		time.Sleep(60 * time.Second)
-		if ch.ch != nil {
-			_, err := ch.ch.SendRequest("keepalive", false, nil)
-			if err != nil {
-				if err != io.EOF {
-					dbg.Debug("keepalive session err: %s", err)
-				}
-				return
-			}
+// Hang up the session process, killing what is left after `kill_timeout`.
+func (ch *Channel) stopProcess() {
+	if ch.exe == nil {
+		return
+	}
+	select {
+	case <-ch.exited:
+	default:
+		dbg.Debug("Hangup session process %d.", ch.exe.Process.Pid)
+		proc.Hangup(ch.exe.Process)
+		timeout := time.Duration(conf.getInt("kill_timeout", 5)) * time.Second
+		select {
+		case <-ch.exited:
+		case <-time.After(timeout):
+			dbg.Debug("Killing session process %d.", ch.exe.Process.Pid)
+			proc.KillTree(ch.exe.Process)
+		}
+	}
+}
+
+// Apply the user's sandbox and `limits` file to the session process.
+// Returns the session cgroup to remove once the session is over.
+func (ch *Channel) confine(exe *exec.Cmd) (string, error) {
+	sb := ch.conn.sandbox()
+	if sb != nil {
+		if err := proc.ApplySandbox(exe, sb); err != nil {
+			return "", err
+		}
+	}
+	pid, err := ch.conn.enterTarget(ch.enterTo)
+	if err != nil {
+		return "", err
+	}
+	if pid != 0 {
+		if sb != nil {
+			return "", ErrEnterSandbox
+		}
+		dbg.Debug("Entering namespaces of %d.", pid)
+		if err := proc.ApplyEnter(exe, pid); err != nil {
+			return "", err
+		}
+	}
+	lines, err := conf.getUserLines(ch.conn.authUser(), "limits")
+	if err != nil {
+		return "", nil
+	}
+	l, err := proc.ParseLimits(lines)
+	if err != nil {
+		return "", err
+	}
+	cgroup, err := proc.NewCgroup(l)
+	if err != nil {
+		return "", err
+	}
+	proc.ApplyLimits(exe, l, cgroup)
+	return cgroup, nil
+}
+
+// Run a shell (cmd == "") or command for the channel once the command
+// policy allows it, the built-in commands are handled here.
+func (conn *ServerConn) commandForChannel(ch *Channel, command string) {
+	command, err := conn.checkCommand(command)
+	if err != nil {
+		dbg.Debug("Command rejected: %v", err)
+		fmt.Fprintf(ch.ch.Stderr(), "sshdog: %v\r\n", err)
+		ch.exitStatus = 1
+		ch.Close()
+		return
+	}
+	cmd, err := shlex.Split(command)
+	if err != nil {
+		dbg.Debug("Error splitting command: %v", err)
+		cmd = nil
+	}
+	dbg.Debug("Command: %v", cmd)
+	if len(cmd) == 0 {
+		// TODO: get the user's shell
+		ch.ExecuteForChannel(defaultShell())
+	} else if cmd[0] == persistAttachCmd {
+		if len(cmd) < 2 || cmd[1] == "-l" {
+			conn.listPersistent(ch.ch)
+			ch.Close()
 		} else {
+			conn.persistentForChannel(ch, cmd[1])
+		}
+	} else if cmd[0] == watchCmd {
+		if err := conn.WatchHandler(cmd, ch); err != nil {
+			dbg.Debug("watch failure: %v", err)
+			fmt.Fprintf(ch.ch.Stderr(), "%s: %v\r\n", watchCmd, err)
+			ch.exitStatus = 1
+			ch.Close()
+		}
+	} else if cmd[0] == tunnelsCmd {
+		conn.listTunnels(ch.ch)
+		ch.Close()
+	} else if cmd[0] == "scp" {
+		if err := conn.SCPHandler(cmd, ch.ch); err != nil {
+			dbg.Debug("scp failure: %v", err)
+			ch.exitStatus = 1
+		}
+	} else {
+		argv, err := conn.commandArgv(command)
+		if err != nil {
+			dbg.Debug("Unable to parse command: %v", err)
+			fmt.Fprintf(ch.ch.Stderr(), "sshdog: %v\r\n", err)
+			ch.exitStatus = 1
+			ch.Close()
 			return
 		}
+		ch.ExecuteForChannel(argv)
+		ch.limitExec()
+	}
+}
+
+// Attach the channel to a detachable session, closing it on failure.
+func (conn *ServerConn) persistentForChannel(ch *Channel, name string) {
+	if err := conn.attachPersistent(ch, name); err != nil {
+		dbg.Debug("Unable to attach session %s: %v", name, err)
+		fmt.Fprintf(ch.ch.Stderr(), "%s: %v\r\n", persistAttachCmd, err)
+		ch.exitStatus = 1
+		ch.Close()
 	}
 }
 
+// parseDims extracts terminal dimensions (width x height) from the provided buffer.
+func parseDims(b []byte) (uint16, uint16) {
+	w := binary.BigEndian.Uint32(b)
+	h := binary.BigEndian.Uint32(b[4:])
+	return uint16(w), uint16(h)
+}
+
 func (conn *ServerConn) HandleSessionChannel(wg *sync.WaitGroup, newChan ssh.NewChannel) {
 	// TODO: refactor this, too long
 	defer wg.Done()
 	channel, reqs, err := newChan.Accept()
-	ch := &Channel{
-		ch:      channel,
-		environ: os.Environ(),
-	}
 	if err != nil {
 		dbg.Debug("Unable to accept newChan: %v", err)
 		return
 	}
+	ch := &Channel{
+		conn:    conn,
+		ch:      conn.trackActivity(channel),
+		environ: conn.loginEnviron(sessionEnviron()),
+	}
+	conn.addSession(ch)
+	defer conn.removeSession(ch)
 	defer ch.Close()
-	go ch.KeepAlive()
+	defer ch.terminate()
+	if authFile, err := conn.writeAuthInfo(); err != nil {
+		dbg.Debug("Unable to write auth info: %v", err)
+	} else if authFile != "" {
+		ch.authFile = authFile
+		ch.environ = setEnv(ch.environ, "SSH_USER_AUTH", authFile)
+	}
 
 	for req := range reqs {
 		success := false
@@ -249,8 +486,10 @@ func (conn *ServerConn) HandleSessionChannel(wg *sync.WaitGroup, newChan ssh.New
 			}
 			ch.pty, err = pty.OpenPty()
 			if ch.pty != nil {
+				ch.rows, ch.cols = uint16(ptyreq.Height), uint16(ptyreq.Width)
 				ch.pty.Resize(uint16(ptyreq.Height), uint16(ptyreq.Width), uint16(ptyreq.WidthPx), uint16(ptyreq.HeightPx))
-				os.Setenv("TERM", ptyreq.Term)
+				ch.environ = setEnv(ch.environ, "TERM", ptyreq.Term)
+				ch.environ = setEnv(ch.environ, "SSH_TTY", ch.pty.Name())
 				// TODO: set pty modes
 			}
 			if err != nil {
@@ -264,12 +503,28 @@ func (conn *ServerConn) HandleSessionChannel(wg *sync.WaitGroup, newChan ssh.New
 				success = false
 			} else {
 				dbg.Debug("env: %s=%s", envreq.Name, envreq.Value)
-				ch.environ = append(ch.environ, fmt.Sprintf("%s=%s", envreq.Name, envreq.Value))
-				success = true
+				if envreq.Name == persistEnv {
+					ch.persistTo = envreq.Value
+					success = validPersistName(envreq.Value)
+				} else if envreq.Name == enterEnv {
+					ch.enterTo = envreq.Value
+					success = true
+				} else if acceptEnv(envreq.Name) {
+					ch.environ = setEnv(ch.environ, envreq.Name, envreq.Value)
+					success = true
+				} else {
+					dbg.Debug("env %s rejected by accept_env.", envreq.Name)
+					success = false
+				}
 			}
 		case "shell":
-			// TODO: get the user's shell
-			ch.ExecuteForChannel(defaultShell())
+			// Attaching to a persistent session is a login too.
+			conn.showMotd(ch)
+			if ch.persistTo != "" {
+				conn.commandForChannel(ch, persistAttachCmd+" "+ch.persistTo)
+			} else {
+				conn.commandForChannel(ch, "")
+			}
 			success = true
 		case "exec":
 			execReq := &ExecRequest{}
@@ -277,24 +532,54 @@ func (conn *ServerConn) HandleSessionChannel(wg *sync.WaitGroup, newChan ssh.New
 				dbg.Debug("Error unmarshaling exec: %v", err)
 				success = false
 			} else {
-				if cmd, err := shlex.Split(execReq.Cmd); err == nil {
-					dbg.Debug("Command: %v", cmd)
-					if cmd[0] == "scp" {
-						if err := conn.SCPHandler(cmd, ch.ch); err != nil {
-							dbg.Debug("scp failure: %v", err)
-							ch.exitStatus = 1
-						}
-					} else {
-						ch.ExecuteForChannel(commandWithShell(execReq.Cmd))
-					}
+				// Like OpenSSH, only a forced command gets to see it.
+				if conn.forcedCommand() != "" {
+					ch.environ = setEnv(ch.environ, "SSH_ORIGINAL_COMMAND", execReq.Cmd)
 				}
+				conn.recordLogin()
+				conn.commandForChannel(ch, execReq.Cmd)
+				success = true
+			}
+		case "auth-agent-req@openssh.com":
+			if ch.agent != nil || conf.userFileExists(conn.authUser(), "no_agent_forwarding") {
+				success = false
+				break
+			}
+			if af, err := conn.startAgentForward(); err != nil {
+				dbg.Debug("Unable to forward agent: %v", err)
+				success = false
+			} else {
+				lock.Lock()
+				ch.agent = af
+				lock.Unlock()
+				ch.environ = setEnv(ch.environ, "SSH_AUTH_SOCK", af.path())
+				success = true
+			}
+		case "x11-req":
+			x11Req := &X11Request{}
+			if ch.x11 != nil || conf.userFileExists(conn.authUser(), "no_x11_forwarding") {
+				success = false
+			} else if err := ssh.Unmarshal(req.Payload, x11Req); err != nil {
+				dbg.Debug("Error unmarshaling x11-req: %v", err)
+				success = false
+			} else if xf, err := conn.startX11Forward(x11Req, ch.environ); err != nil {
+				dbg.Debug("Unable to forward X11: %v", err)
+				success = false
+			} else {
+				lock.Lock()
+				ch.x11 = xf
+				lock.Unlock()
+				ch.environ = setEnv(ch.environ, "DISPLAY", xf.displayName())
+				success = true
 			}
-			success = true
 		case "window-change":
 			w, h := parseDims(req.Payload)
 			dbg.Debug("window resize %dx%d", w, h)
-			ch.pty.Resize(h, w, 0, 0)
-			success = true
+			ch.rows, ch.cols = h, w
+			if ch.pty != nil {
+				ch.pty.Resize(h, w, 0, 0)
+				success = true
+			}
 		default:
 			dbg.Debug("Unknown session request: %s", req.Type)
 			success = false
@@ -326,7 +611,17 @@ func (conn *ServerConn) HandleTCPIPChannel(wg *sync.WaitGroup, newChan ssh.NewCh
 	}
 	dbg.Debug("Forwarding request: %v", msg)
 
-	outbound, err := net.Dial("tcp", fmt.Sprintf("%s:%d", msg.Host, msg.Port))
+	ips, err := conn.permittedAddrs("permit_open", msg.Host, int(msg.Port), conn.lookupDest)
+	if err == ErrForwardDenied {
+		newChan.Reject(ssh.Prohibited, err.Error())
+		return
+	} else if err != nil {
+		dbg.Debug("Unable to resolve forward: %v", err)
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	outbound, err := conn.dialForward("tcp", msg.Host, ips, int(msg.Port))
 	if err != nil {
 		dbg.Debug("Unable to dial forward: %v", err)
 		newChan.Reject(ssh.ConnectionFailed, err.Error())
@@ -352,8 +647,7 @@ func (conn *ServerConn) HandleTCPIPChannel(wg *sync.WaitGroup, newChan ssh.NewCh
 			}
 		}
 	}()
-	go io.Copy(ch, outbound)
-	io.Copy(outbound, ch)
+	conn.relay("direct-tcpip", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))), ch, outbound)
 
 	dbg.Debug("Closing forwarding request: %v", msg)
 }
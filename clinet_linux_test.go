@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openFds(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fds)
+}
+
+// Count the live children of the test. As a subreaper it also inherits
+// whatever a session leaves running after its shell is gone.
+func childProcesses(t *testing.T) int {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, name := range stats {
+		stat, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		// comm may contain spaces, fields start after the last ')'
+		i := strings.LastIndexByte(string(stat), ')')
+		if i < 0 {
+			continue
+		}
+		// state ppid ...
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) > 1 && fields[0] != "Z" && fields[1] == strconv.Itoa(os.Getpid()) {
+			n++
+		}
+	}
+	return n
+}
+
+// Start a long running command, half of them on a pty, and drop the
+// connection under it.
+func dropSession(addr string, key ssh.Signer, withPty bool) error {
+	client, err := dialTestServer(addr, "test", key)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	if withPty {
+		if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+			return err
+		}
+	}
+	// The background sleep outlives the shell unless its group is killed.
+	if err := sess.Start("sleep 60 & sleep 60"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func dropSessions(t *testing.T, addr string, key ssh.Signer, n int) {
+	const parallel = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i += parallel {
+		for j := i; j < i+parallel && j < n; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				if err := dropSession(addr, key, j%2 == 1); err != nil {
+					errs <- err
+				}
+			}(j)
+		}
+		wg.Wait()
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestDroppedSessionsLeaveNothingBehind(t *testing.T) {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	s, key := newTestServer(t)
+	defer os.RemoveAll(conf.dir)
+	addr := listenTestServer(t, s)
+
+	// Let lazily started goroutines and fds settle first.
+	dropSessions(t, addr, key, 4)
+	time.Sleep(2 * time.Second)
+	goroutines, fds, children := runtime.NumGoroutine(), openFds(t), childProcesses(t)
+
+	dropSessions(t, addr, key, 300)
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		g, f, c := runtime.NumGoroutine(), openFds(t), childProcesses(t)
+		// A little slack for goroutines the runtime parks.
+		if g <= goroutines+5 && f <= fds && c <= children {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after 300 sessions: %d goroutines (was %d), %d fds (was %d), %d processes (was %d)",
+				g, goroutines, f, fds, c, children)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
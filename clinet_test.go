@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// An in-process server with an empty config dir, and a client key.
+// The caller removes conf.dir.
+func newTestServer(t *testing.T) (*Server, ssh.Signer) {
+	dir, err := ioutil.TempDir("", "sshdog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "kill_timeout"), []byte("1\n"), 0600)
+	conf = &config{dir: dir}
+
+	s := NewServer()
+	if err := s.configureAlgorithms(); err != nil {
+		t.Fatal(err)
+	}
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addHostSigner(hostSigner)
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	userSigner, err := ssh.NewSignerFromKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddAuthorizedKeys(ssh.MarshalAuthorizedKey(userSigner.PublicKey()))
+	return s, userSigner
+}
+
+// Serve s on a loopback port. net.Pipe won't do, both sides write their
+// version at once and an unbuffered pipe deadlocks on it.
+func listenTestServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func dialTestServer(addr, user string, key ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// sshdog-udp exposes a UDP service behind an sshdog server as a local
+// UDP port, like ssh -L does for TCP:
+//
+//	sshdog-udp -i key -fingerprint SHA256:... -L 5353:10.0.0.1:53 user@host
+//
+// Every local peer gets its own channel, so replies go back to the sender.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hengwu0/sshdog/datagram"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type forwards []string
+
+func (f *forwards) String() string     { return strings.Join(*f, ",") }
+func (f *forwards) Set(s string) error { *f = append(*f, s); return nil }
+
+var (
+	keyFile     = flag.String("i", "", "private key file.")
+	port        = flag.Int("p", 1022, "server port.")
+	fingerprint = flag.String("fingerprint", "", "expected SHA256 fingerprint of the host key.")
+	insecure    = flag.Bool("insecure", false, "accept any host key.")
+	idle        = flag.Duration("idle", 2*time.Minute, "close a peer's channel after this long without traffic, 0 to keep it open.")
+	locals      forwards
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s -i key (-fingerprint SHA256:... | -insecure) -L [bind:]port:host:hostport... [user@]host\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Var(&locals, "L", "[bind:]port:host:hostport, forward a local UDP port.")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 || len(locals) == 0 || *keyFile == "" || (*fingerprint == "" && !*insecure) {
+		usage()
+	}
+
+	target := flag.Arg(0)
+	name := ""
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		name, target = target[:i], target[i+1:]
+	}
+	key, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		fatal(err)
+	}
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: checkHostKey,
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(target, strconv.Itoa(*port)), config)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	for _, spec := range locals {
+		if err := listen(client, spec); err != nil {
+			fatal(err)
+		}
+	}
+	client.Wait()
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "sshdog-udp: %v\n", err)
+	os.Exit(1)
+}
+
+func checkHostKey(host string, remote net.Addr, key ssh.PublicKey) error {
+	if *insecure || ssh.FingerprintSHA256(key) == *fingerprint {
+		return nil
+	}
+	return fmt.Errorf("host key %s does not match %s", ssh.FingerprintSHA256(key), *fingerprint)
+}
+
+// Parse [bind:]port:host:hostport.
+func parseForward(spec string) (string, *datagram.Message, error) {
+	parts := strings.Split(spec, ":")
+	bind := "127.0.0.1"
+	if len(parts) == 4 {
+		bind, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("bad forward %q", spec)
+	}
+	hostPort, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return "", nil, fmt.Errorf("bad forward %q", spec)
+	}
+	return net.JoinHostPort(bind, parts[0]), &datagram.Message{Host: parts[1], Port: uint32(hostPort)}, nil
+}
+
+// A local peer and its channel.
+type peer struct {
+	ch     ssh.Channel
+	active time.Time
+}
+
+func listen(client *ssh.Client, spec string) error {
+	local, msg, err := parseForward(spec)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", local)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	peers := make(map[string]*peer)
+
+	if *idle > 0 {
+		go reap(&mu, peers)
+	}
+
+	go func() {
+		buf := make([]byte, datagram.MaxSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				fatal(err)
+			}
+			mu.Lock()
+			p, ok := peers[addr.String()]
+			if ok {
+				p.active = time.Now()
+			}
+			mu.Unlock()
+			if !ok {
+				// Only this goroutine adds peers, so the channel can be
+				// opened without holding up the others.
+				m := *msg
+				if ua, ok := addr.(*net.UDPAddr); ok {
+					m.SourceIP, m.SourcePort = ua.IP.String(), uint32(ua.Port)
+				}
+				ch, reqs, err := client.OpenChannel(datagram.ChannelType, ssh.Marshal(&m))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "sshdog-udp: %s: %v\n", spec, err)
+					continue
+				}
+				go ssh.DiscardRequests(reqs)
+				p = &peer{ch: ch, active: time.Now()}
+				mu.Lock()
+				peers[addr.String()] = p
+				mu.Unlock()
+				go func(addr net.Addr, p *peer) {
+					replies(pc, addr, p.ch)
+					p.ch.Close()
+					mu.Lock()
+					if peers[addr.String()] == p {
+						delete(peers, addr.String())
+					}
+					mu.Unlock()
+				}(addr, p)
+			}
+			if err := datagram.Write(p.ch, buf[:n]); err != nil {
+				fmt.Fprintf(os.Stderr, "sshdog-udp: %s: %v\n", spec, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close the channels of peers idle for longer than -idle.
+func reap(mu *sync.Mutex, peers map[string]*peer) {
+	for range time.Tick(*idle / 4) {
+		mu.Lock()
+		for addr, p := range peers {
+			if time.Since(p.active) > *idle {
+				p.ch.Close()
+				delete(peers, addr)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// Send the datagrams coming back on ch to the peer.
+func replies(pc net.PacketConn, addr net.Addr, ch ssh.Channel) {
+	r := datagram.NewReader(ch)
+	buf := make([]byte, datagram.MaxSize)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(buf[:n], addr)
+	}
+}
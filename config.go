@@ -41,6 +41,21 @@ func (c *config) getPort() int16 {
 	return 1022 // default
 }
 
+// Read a number from a config file, def if missing or invalid.
+func (c *config) getInt(name string, def int) int {
+	data, err := c.getBytes(name)
+	if err != nil {
+		return def
+	}
+	str := strings.TrimSpace(string(data))
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing %s as %s: %v, use %d for default.", str, name, err, def)
+		return def
+	}
+	return n
+}
+
 // Just check if a file exists
 func (c *config) fileExists(name string) bool {
 	_, err := c.getBytes(name)
@@ -71,6 +86,61 @@ func (c *config) getBytes(name string) ([]byte, error) {
 	return content, nil
 }
 
+// Read a config file as a list of lines, skipping blanks and '#' comments.
+func (c *config) getLines(name string) ([]string, error) {
+	content, err := c.getBytes(name)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, 8)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func validUserName(user string) bool {
+	return user != "" && user != "." && user != ".." && !strings.ContainsAny(user, "/\\\x00")
+}
+
+// Per-user files live in users/<name>/ and override the global ones.
+// user must be the one authentication admitted, ServerConn.authUser.
+func (c *config) userPath(user, name string) string {
+	if !validUserName(user) {
+		return name
+	}
+	if p := path.Join("users", user, name); c.fileExists(p) {
+		return p
+	}
+	return name
+}
+
+func (c *config) getUserBytes(user, name string) ([]byte, error) {
+	return c.getBytes(c.userPath(user, name))
+}
+
+func (c *config) getUserLines(user, name string) ([]string, error) {
+	return c.getLines(c.userPath(user, name))
+}
+
+func (c *config) getUserInt(user, name string, def int) int {
+	return c.getInt(c.userPath(user, name), def)
+}
+
+func (c *config) userFileExists(user, name string) bool {
+	return c.fileExists(c.userPath(user, name))
+}
+
+// A user with a users/<name>/ directory logs in only with the keys in
+// its own authorized_keys, the global ones would escape its overrides.
+func (c *config) hasUserDir(user string) bool {
+	return validUserName(user) && c.findDir(path.Join("users", user))
+}
+
 func (c *config) findDir(name string) bool {
 	if f, err := os.Stat(path.Join(c.dir, name)); err != nil {
 		return false
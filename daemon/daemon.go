@@ -2,5 +2,10 @@
 
 package daemon
 
+import "os"
+
+// Files the restarted process inherits, as fd 3 and up.
+var ExtraFiles []*os.File
+
 // Start and return a wait and stop function
 type DaemonWorker func() (func(), func())
@@ -58,6 +58,8 @@ func Daemonize(f DaemonWorker, dbg bool) error {
 	// Setup some other stuff
 	//cmd.Dir = "/"	//can't find config dir
 
+	cmd.ExtraFiles = ExtraFiles
+
 	// Prevent signals from getting there
 	cmd.SysProcAttr.Setsid = true
 
@@ -0,0 +1,78 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// UDP forwarding over SSH.
+// A direct-udp@sshdog channel is opened with the same payload as
+// direct-tcpip and carries datagrams both ways, each one prefixed with
+// its length as a big endian uint16.
+
+package datagram
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const ChannelType = "direct-udp@sshdog"
+
+// Largest datagram a frame can hold.
+const MaxSize = 65535
+
+var ErrTooLarge = errors.New("Datagram too large.")
+
+// Payload of the channel open request.
+type Message struct {
+	Host       string
+	Port       uint32
+	SourceIP   string
+	SourcePort uint32
+}
+
+// Write one datagram.
+func Write(w io.Writer, b []byte) error {
+	if len(b) > MaxSize {
+		return ErrTooLarge
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Reads the datagrams of a stream, one per Read.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReaderSize(r, 2+MaxSize)}
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r.r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(b) {
+		if _, err := r.r.Discard(n); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(r.r, b[:n])
+}
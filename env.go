@@ -0,0 +1,210 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Per-session environment handling.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Client variables accepted when there is no `accept_env` file.
+var defaultAcceptEnv = []string{
+	"LANG",
+	"LC_*",
+}
+
+// Variables a client may never set, whatever `accept_env` says.
+var deniedEnv = []string{
+	"LD_*",
+	"DYLD_*",
+	"BASH_ENV",
+	"BASH_FUNC_*",
+	"ENV",
+	"IFS",
+	"SHELLOPTS",
+	"BASHOPTS",
+	"PS4",
+	"GCONV_PATH",
+	"HOSTALIASES",
+	"LOCALDOMAIN",
+	"RES_OPTIONS",
+	"NLSPATH",
+	"TMPDIR",
+	"PATH",
+	"HOME",
+	"USER",
+	"LOGNAME",
+	"SHELL",
+	"MAIL",
+	"TERM",
+	"SSH_*",
+}
+
+// Variables windows can't start a shell without.
+var windowsEnv = []string{
+	"SYSTEMROOT",
+	"WINDIR",
+	"COMSPEC",
+	"PATHEXT",
+	"PATH",
+	"TEMP",
+	"TMP",
+}
+
+// Build the starting environment of a session.
+// The daemon's own environment is not inherited, only the `environment`
+// config file (NAME=value per line) is used.
+func sessionEnviron() []string {
+	env := make([]string, 0, 16)
+	if runtime.GOOS == "windows" {
+		for _, kv := range os.Environ() {
+			if name, _ := splitEnv(kv); matchEnv(strings.ToUpper(name), windowsEnv) {
+				env = append(env, kv)
+			}
+		}
+	}
+	if lines, err := conf.getLines("environment"); err == nil {
+		for _, line := range lines {
+			if name, value := splitEnv(line); name != "" {
+				env = setEnv(env, name, value)
+			}
+		}
+	}
+	return env
+}
+
+// PATH used when the `environment` file doesn't set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Home directory of the session. sshdog doesn't switch users, sessions
+// run as the user we run as, so that is the home they get.
+func sessionHome() string {
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return ""
+}
+
+// Add the variables OpenSSH sets for every session.
+func (conn *ServerConn) loginEnviron(env []string) []string {
+	name := conn.User()
+	env = setEnv(env, "USER", name)
+	env = setEnv(env, "LOGNAME", name)
+	if home := sessionHome(); home != "" {
+		env = setEnv(env, "HOME", home)
+	}
+	env = setEnv(env, "SHELL", defaultShell()[0])
+	if runtime.GOOS != "windows" {
+		if getEnv(env, "PATH") == "" {
+			env = setEnv(env, "PATH", defaultPath)
+		}
+		env = setEnv(env, "MAIL", filepath.Join("/var/mail", name))
+	}
+
+	rHost, rPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	lHost, lPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	env = setEnv(env, "SSH_CLIENT", fmt.Sprintf("%s %s %s", rHost, rPort, lPort))
+	env = setEnv(env, "SSH_CONNECTION", fmt.Sprintf("%s %s %s %s", rHost, rPort, lHost, lPort))
+	return env
+}
+
+// Write the authentication details to a private file for SSH_USER_AUTH.
+// Only done when the `expose_auth_info` file exists.
+func (conn *ServerConn) writeAuthInfo() (string, error) {
+	if !conf.fileExists("expose_auth_info") {
+		return "", nil
+	}
+	info := "none"
+	if conn.Permissions != nil {
+		if v, ok := conn.Permissions.Extensions["auth-info"]; ok {
+			info = v
+		}
+	}
+	fp, err := ioutil.TempFile("", "sshauth.")
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	if _, err := fmt.Fprintln(fp, info); err != nil {
+		os.Remove(fp.Name())
+		return "", err
+	}
+	return fp.Name(), nil
+}
+
+// Check a client supplied variable against AcceptEnv and the denylist.
+func acceptEnv(name string) bool {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return false
+	}
+	if matchEnv(name, deniedEnv) {
+		return false
+	}
+	patterns, err := conf.getLines("accept_env")
+	if err != nil {
+		patterns = defaultAcceptEnv
+	}
+	return matchEnv(name, patterns)
+}
+
+// Match a name against a list of shell-style wildcard patterns.
+func matchEnv(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		for _, p := range strings.Fields(pattern) {
+			if ok, err := filepath.Match(p, name); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func splitEnv(kv string) (string, string) {
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(kv[:i]), kv[i+1:]
+}
+
+// Set a variable, replacing any previous value.
+func setEnv(env []string, name, value string) []string {
+	prefix := name + "="
+	for i, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
+
+// Look up a variable.
+func getEnv(env []string, name string) string {
+	prefix := name + "="
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return kv[len(prefix):]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Remote port forwarding (tcpip-forward, ssh -R).
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Payload of tcpip-forward and cancel-tcpip-forward.
+type tcpipForwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+// Payload of forwarded-tcpip.
+type forwardedTCPIPMessage struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// A port listening for the client's ssh -R.
+type tcpForward struct {
+	addr     string // as requested by the client
+	port     uint32 // as bound
+	listener net.Listener
+}
+
+func tcpForwardKey(addr string, port uint32) string {
+	return net.JoinHostPort(addr, strconv.Itoa(int(port)))
+}
+
+// Address to bind for a requested one, following the `gateway_ports`
+// file like GatewayPorts: "no" (the default) binds loopback only, "yes"
+// all addresses, and "clientspecified" what the client asked for.
+func (conn *ServerConn) bindHost(addr string) string {
+	gateway := "no"
+	if data, err := conf.getUserBytes(conn.authUser(), "gateway_ports"); err == nil {
+		gateway = strings.TrimSpace(string(data))
+	}
+	switch gateway {
+	case "yes":
+		return "0.0.0.0"
+	case "clientspecified":
+		switch addr {
+		case "", "*", "0.0.0.0", "::":
+			return "0.0.0.0"
+		case "localhost":
+			return "127.0.0.1"
+		}
+		return addr
+	}
+	return "127.0.0.1"
+}
+
+// Handle tcpip-forward, the reply holds the port bound when 0 was asked.
+func (conn *ServerConn) startTCPForward(payload []byte) ([]byte, error) {
+	var req tcpipForwardRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Port > 65535 {
+		return nil, ErrBadRule
+	}
+	host := conn.bindHost(req.Addr)
+	ips, err := conn.permittedAddrs("permit_listen", host, int(req.Port), lookupLocal)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("unknown address %s", host)
+	}
+	if req.Port != 0 && req.Port < 1024 && !conn.privilegedListenAllowed(host, ips[0], int(req.Port)) {
+		conn.audit("rejected permit_listen to %s: %v", net.JoinHostPort(host, strconv.Itoa(int(req.Port))), ErrPrivileged)
+		return nil, ErrPrivileged
+	}
+	bind := ips[0].String()
+	if ips[0].IsUnspecified() {
+		bind = ""
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		return nil, err
+	}
+	tf := &tcpForward{
+		addr:     req.Addr,
+		port:     uint32(listener.Addr().(*net.TCPAddr).Port),
+		listener: listener,
+	}
+	// Port 0 was checked as 0, check the port actually allocated.
+	if req.Port == 0 {
+		if _, err := conn.permittedAddrs("permit_listen", host, int(tf.port), lookupLocal); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	conn.fwdLock.Lock()
+	if conn.tcpForwards == nil {
+		conn.tcpForwards = make(map[string]*tcpForward)
+	}
+	conn.tcpForwards[tcpForwardKey(tf.addr, tf.port)] = tf
+	conn.fwdLock.Unlock()
+	dbg.Debug("Forwarding %s to the client.", listener.Addr())
+	go tf.serve(conn)
+
+	if req.Port == 0 {
+		return ssh.Marshal(struct{ Port uint32 }{tf.port}), nil
+	}
+	return nil, nil
+}
+
+// Handle cancel-tcpip-forward.
+func (conn *ServerConn) cancelTCPForward(payload []byte) error {
+	var req tcpipForwardRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	key := tcpForwardKey(req.Addr, req.Port)
+	conn.fwdLock.Lock()
+	tf, ok := conn.tcpForwards[key]
+	delete(conn.tcpForwards, key)
+	conn.fwdLock.Unlock()
+	if !ok {
+		return ErrForwardDenied
+	}
+	tf.listener.Close()
+	return nil
+}
+
+// Stop every remote port forwarding of the connection.
+func (conn *ServerConn) closeTCPForwards() {
+	conn.fwdLock.Lock()
+	forwards := conn.tcpForwards
+	conn.tcpForwards = nil
+	conn.fwdLock.Unlock()
+	for _, tf := range forwards {
+		tf.listener.Close()
+	}
+}
+
+func (tf *tcpForward) serve(conn *ServerConn) {
+	for {
+		c, err := tf.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			msg := forwardedTCPIPMessage{Addr: tf.addr, Port: tf.port}
+			if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+				msg.OriginAddr = addr.IP.String()
+				msg.OriginPort = uint32(addr.Port)
+			}
+			ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&msg))
+			if err != nil {
+				dbg.Debug("Unable to open forwarded-tcpip channel: %v", err)
+				return
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(reqs)
+			conn.relay("forwarded-tcpip", c.RemoteAddr().String()+" via "+tf.listener.Addr().String(), ch, c)
+		}(c)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Global requests (RFC 4254 section 4).
+// Requests without a handler get a failure reply.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"sync/atomic"
+)
+
+var (
+	ErrUnknownRequest = errors.New("Unknown global request.")
+	ErrUnknownHostKey = errors.New("Not one of our host keys.")
+)
+
+// A handler returns the reply payload, an error makes the reply a failure.
+type globalHandler func(conn *ServerConn, payload []byte) ([]byte, error)
+
+var globalHandlers = map[string]globalHandler{}
+
+func registerGlobal(name string, h globalHandler) {
+	globalHandlers[name] = h
+}
+
+func init() {
+	registerGlobal("keepalive@openssh.com", (*ServerConn).keepalive)
+	registerGlobal("no-more-sessions@openssh.com", (*ServerConn).noMoreSessions)
+	registerGlobal("hostkeys-prove-00@openssh.com", (*ServerConn).proveHostKeys)
+	registerGlobal("tcpip-forward", (*ServerConn).startTCPForward)
+	registerGlobal("cancel-tcpip-forward", noReply((*ServerConn).cancelTCPForward))
+	registerGlobal("streamlocal-forward@openssh.com", noReply((*ServerConn).startStreamForward))
+	registerGlobal("cancel-streamlocal-forward@openssh.com", noReply((*ServerConn).cancelStreamForward))
+}
+
+// Adapt a handler without reply payload.
+func noReply(h func(*ServerConn, []byte) error) globalHandler {
+	return func(conn *ServerConn, payload []byte) ([]byte, error) {
+		return nil, h(conn, payload)
+	}
+}
+
+func (conn *ServerConn) ServiceGlobalRequests() {
+	for r := range conn.reqs {
+		dbg.Debug("Received request %s plus %d bytes.", r.Type, len(r.Payload))
+		var reply []byte
+		err := ErrUnknownRequest
+		if h, ok := globalHandlers[r.Type]; ok {
+			reply, err = h(conn, r.Payload)
+		}
+		if err != nil {
+			dbg.Debug("Request %s failed: %v", r.Type, err)
+		}
+		if r.WantReply {
+			r.Reply(err == nil, reply)
+		}
+	}
+}
+
+// Clients only need some reply to know we are alive.
+func (conn *ServerConn) keepalive(payload []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// The client promises not to open more sessions, see HandleConn.
+func (conn *ServerConn) noMoreSessions(payload []byte) ([]byte, error) {
+	atomic.StoreInt32(&conn.sessionsDisabled, 1)
+	return nil, nil
+}
+
+func (conn *ServerConn) sessionsAllowed() bool {
+	return atomic.LoadInt32(&conn.sessionsDisabled) == 0
+}
+
+// Sign every host key the client lists, proving we hold them.
+func (conn *ServerConn) proveHostKeys(payload []byte) ([]byte, error) {
+	var sigs bytes.Buffer
+	for len(payload) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, err
+		}
+		payload = blob.Rest
+		signer := conn.hostKey(blob.Key)
+		if signer == nil {
+			return nil, ErrUnknownHostKey
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", conn.SessionID(), blob.Key})
+		sig, err := signHostKey(signer, data)
+		if err != nil {
+			return nil, err
+		}
+		sigs.Write(ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)}))
+	}
+	return sigs.Bytes(), nil
+}
+
+func (conn *ServerConn) hostKey(blob []byte) ssh.Signer {
+	for _, keys := range [][]ssh.Signer{conn.hostKeys, conn.nextKeys} {
+		for _, k := range keys {
+			if bytes.Equal(k.PublicKey().Marshal(), blob) {
+				return k
+			}
+		}
+	}
+	return nil
+}
+
+// Tell the client all our host keys, current and staged, with
+// hostkeys-00@openssh.com. OpenSSH's UpdateHostKeys then asks us to prove
+// the ones it doesn't know yet and adds them to known_hosts.
+func (conn *ServerConn) announceHostKeys() {
+	var keys bytes.Buffer
+	for _, list := range [][]ssh.Signer{conn.hostKeys, conn.nextKeys} {
+		for _, k := range list {
+			keys.Write(ssh.Marshal(struct{ Key []byte }{k.PublicKey().Marshal()}))
+		}
+	}
+	if keys.Len() == 0 {
+		return
+	}
+	if _, _, err := conn.SendRequest("hostkeys-00@openssh.com", false, keys.Bytes()); err != nil {
+		dbg.Debug("Unable to announce host keys: %v", err)
+	}
+}
+
+// RSA keys sign with SHA-512 as OpenSSH does, SHA-1 is refused nowadays.
+func signHostKey(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return as.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	}
+	return signer.Sign(rand.Reader, data)
+}
@@ -0,0 +1,341 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Host key sources.
+// Encrypted PEM and OpenSSH keys are decrypted with the passphrase in the
+// `hostkey_passphrase` file, the SSHDOG_HOSTKEY_PASSPHRASE environment
+// variable or typed at start. With a `hostkey_agent` file, holding an
+// ssh-agent socket or empty for $SSH_AUTH_SOCK, a <key>.pub without its
+// private key is signed for by the agent, like OpenSSH's HostKeyAgent.
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/hengwu0/sshdog/daemon"
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	passphraseEnv   = "SSHDOG_HOSTKEY_PASSPHRASE"
+	passphraseFdEnv = "SSHDOG_HOSTKEY_PASSPHRASE_FD"
+)
+
+var (
+	ErrNoPassphrase  = errors.New("Host key is encrypted but no passphrase given.")
+	ErrBadPassphrase = errors.New("Wrong host key passphrase.")
+	ErrKeyCipher     = errors.New("Unsupported host key encryption.")
+	ErrAgentKey      = errors.New("Host key not held by the agent.")
+)
+
+var hostKeyPassphrase []byte
+
+// Our end of the pipe the daemon reads the passphrase from.
+var passphrasePipe *os.File
+
+// Ask for the passphrase if a host key needs one and it isn't configured.
+// The daemon is a new process, so it reads the answer from an inherited
+// pipe; only the descriptor number is in its environment.
+func promptPassphrase() {
+	if conf.fileExists("hostkey_passphrase") || os.Getenv(passphraseEnv) != "" || os.Getenv(passphraseFdEnv) != "" {
+		return
+	}
+	encrypted := false
+	for _, keyName := range keyNames {
+		for _, name := range []string{keyName, keyName + ".next"} {
+			if data, err := conf.getBytes(name); err == nil && isEncryptedKey(data) {
+				encrypted = true
+			}
+		}
+	}
+	if !encrypted || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Host key passphrase: ")
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read passphrase: %v\n", err)
+		return
+	}
+	hostKeyPassphrase = pass
+	if !conf.shouldDaemon {
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to pass on passphrase: %v\n", err)
+		return
+	}
+	// Far below the pipe buffer, so this doesn't wait for the reader.
+	w.Write(pass)
+	w.Close()
+	passphrasePipe = r
+	daemon.ExtraFiles = append(daemon.ExtraFiles, r)
+	os.Setenv(passphraseFdEnv, strconv.Itoa(2+len(daemon.ExtraFiles)))
+}
+
+// Take the passphrase and drop it from the environment.
+func loadPassphrase() {
+	if data, err := conf.getBytes("hostkey_passphrase"); err == nil {
+		hostKeyPassphrase = bytes.TrimRight(data, "\r\n")
+	} else if pass := os.Getenv(passphraseEnv); pass != "" {
+		hostKeyPassphrase = []byte(pass)
+	} else if hostKeyPassphrase != nil {
+		// Typed here, the process was a daemon already.
+	} else if fd, err := strconv.Atoi(os.Getenv(passphraseFdEnv)); err == nil && fd > 2 {
+		fp := os.NewFile(uintptr(fd), "passphrase")
+		if pass, err := ioutil.ReadAll(fp); err == nil {
+			hostKeyPassphrase = pass
+		}
+		fp.Close()
+	}
+	if passphrasePipe != nil {
+		passphrasePipe.Close()
+		passphrasePipe = nil
+	}
+	os.Unsetenv(passphraseEnv)
+	os.Unsetenv(passphraseFdEnv)
+}
+
+func isEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return true
+	}
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		if w, err := parseOpenSSHKey(block.Bytes); err == nil {
+			return w.CipherName != "none"
+		}
+	}
+	return false
+}
+
+// Parse a host key, decrypting it if need be.
+func parseHostKey(data []byte) (ssh.Signer, error) {
+	if !isEncryptedKey(data) {
+		return ssh.ParsePrivateKey(data)
+	}
+	if hostKeyPassphrase == nil {
+		return nil, ErrNoPassphrase
+	}
+	block, _ := pem.Decode(data)
+	if block.Type != "OPENSSH PRIVATE KEY" {
+		return ssh.ParsePrivateKeyWithPassphrase(data, hostKeyPassphrase)
+	}
+	plain, err := decryptOpenSSHKey(block.Bytes, hostKeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: plain}))
+}
+
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+// The openssh-key-v1 format, see PROTOCOL.key in OpenSSH.
+type openSSHKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+func parseOpenSSHKey(data []byte) (*openSSHKey, error) {
+	if !bytes.HasPrefix(data, []byte(openSSHKeyMagic)) {
+		return nil, ErrKeyCipher
+	}
+	w := &openSSHKey{}
+	if err := ssh.Unmarshal(data[len(openSSHKeyMagic):], w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// The ssh package only reads unencrypted OpenSSH keys, so decrypt the
+// private block and hand it back as such.
+func decryptOpenSSHKey(data, pass []byte) ([]byte, error) {
+	w, err := parseOpenSSHKey(data)
+	if err != nil {
+		return nil, err
+	}
+	var keyLen int
+	var mode func(cipher.Block, []byte) cipher.BlockMode
+	ctr := false
+	switch w.CipherName {
+	case "aes128-ctr", "aes192-ctr", "aes256-ctr":
+		ctr = true
+	case "aes128-cbc", "aes192-cbc", "aes256-cbc":
+		mode = cipher.NewCBCDecrypter
+	default:
+		return nil, ErrKeyCipher
+	}
+	fmt.Sscanf(w.CipherName, "aes%d", &keyLen)
+	keyLen /= 8
+	if w.KdfName != "bcrypt" {
+		return nil, ErrKeyCipher
+	}
+	var opts struct {
+		Salt   []byte
+		Rounds uint32
+	}
+	if err := ssh.Unmarshal([]byte(w.KdfOpts), &opts); err != nil {
+		return nil, err
+	}
+	if len(w.PrivKeyBlock)%aes.BlockSize != 0 {
+		return nil, ErrKeyCipher
+	}
+	k := bcryptPBKDF(pass, opts.Salt, int(opts.Rounds), keyLen+aes.BlockSize)
+	block, err := aes.NewCipher(k[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(w.PrivKeyBlock))
+	if ctr {
+		cipher.NewCTR(block, k[keyLen:]).XORKeyStream(plain, w.PrivKeyBlock)
+	} else {
+		mode(block, k[keyLen:]).CryptBlocks(plain, w.PrivKeyBlock)
+	}
+	// Both check ints match only with the right passphrase.
+	if len(plain) < 8 || !bytes.Equal(plain[:4], plain[4:8]) {
+		return nil, ErrBadPassphrase
+	}
+	w.CipherName, w.KdfName, w.KdfOpts, w.PrivKeyBlock = "none", "none", "", plain
+	return append([]byte(openSSHKeyMagic), ssh.Marshal(w)...), nil
+}
+
+// bcrypt_pbkdf as used by OpenSSH for key files.
+func bcryptPBKDF(pass, salt []byte, rounds, keyLen int) []byte {
+	const blockSize = 32
+	numBlocks := (keyLen + blockSize - 1) / blockSize
+	key := make([]byte, numBlocks*blockSize)
+	h := sha512.New()
+	h.Write(pass)
+	shapass := h.Sum(nil)
+	shasalt := make([]byte, 0, sha512.Size)
+	tmp := make([]byte, blockSize)
+	for n := 1; n <= numBlocks; n++ {
+		h.Reset()
+		h.Write(salt)
+		h.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		bcryptHash(tmp, shapass, h.Sum(shasalt))
+		out := make([]byte, blockSize)
+		copy(out, tmp)
+		for i := 2; i <= rounds; i++ {
+			h.Reset()
+			h.Write(tmp)
+			bcryptHash(tmp, shapass, h.Sum(shasalt))
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+		for i, v := range out {
+			key[i*numBlocks+n-1] = v
+		}
+	}
+	return key[:keyLen]
+}
+
+func bcryptHash(out, shapass, shasalt []byte) {
+	c, _ := blowfish.NewSaltedCipher(shapass, shasalt)
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shasalt, c)
+		blowfish.ExpandKey(shapass, c)
+	}
+	copy(out, "OxychromaticBlowfishSwatDynamite")
+	for i := 0; i < 32; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+8], out[i:i+8])
+		}
+	}
+	// Blowfish words are big endian, bcrypt_pbkdf wants them little.
+	for i := 0; i < 32; i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+	}
+}
+
+// A host key held by an ssh-agent. Every signature dials the socket, so
+// a restarted agent is picked up.
+type agentSigner struct {
+	socket string
+	pub    ssh.PublicKey
+}
+
+func hostKeyAgentSocket() string {
+	data, _ := conf.getBytes("hostkey_agent")
+	if socket := strings.TrimSpace(string(data)); socket != "" {
+		return socket
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+func newAgentSigner(socket string, pub ssh.PublicKey) (*agentSigner, error) {
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	keys, err := agent.NewClient(c).List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return &agentSigner{socket: socket, pub: pub}, nil
+		}
+	}
+	return nil, ErrAgentKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.SigAlgoRSASHA2256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.SigAlgoRSASHA2512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	c, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return agent.NewClient(c).SignWithFlags(s.pub, data, flags)
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// From OpenBSD's bcrypt_pbkdf, the last one spans several output blocks.
+var bcryptPBKDFVectors = []struct {
+	pass, salt string
+	rounds     int
+	key        string
+}{
+	{"password", "salt", 12,
+		"1ae42c05d487bc02f64921a4ebe4ea93bcacfe135fda99974c06b7b01fae149a"},
+	{"passwordy\x00PASSWORD\x00", "salty\x00SALT\x00", 3,
+		"7f310bd3e78c3280c59ce4595211a2928e8d4ec744c1ed2efc9f764e3388e0ad"},
+	{"секретное слово", "посолить немножко", 8,
+		"8df43fc6fe131fc47f0c9e39224bd94c70b6fcc8ee8135faddf61156e6cb2733" +
+			"ea765f315a3e1e4afc35bf8687d189254c1e05a6fe80c0617f9183d67260d6a1" +
+			"15c6c94e3603e2303fbb43a76a64523ffda686b1d4518543"},
+}
+
+func TestBcryptPBKDF(t *testing.T) {
+	for _, v := range bcryptPBKDFVectors {
+		want, _ := hex.DecodeString(v.key)
+		got := bcryptPBKDF([]byte(v.pass), []byte(v.salt), v.rounds, len(want))
+		if !bytes.Equal(got, want) {
+			t.Errorf("bcrypt_pbkdf(%q, %q, %d) = %x, want %x", v.pass, v.salt, v.rounds, got, want)
+		}
+	}
+}
+
+// Keys made by ssh-keygen -N passphrase, in testdata with their .pub.
+var encryptedHostKeys = []string{
+	"hostkey_ed25519_ctr", // OpenSSH format, aes256-ctr
+	"hostkey_rsa_cbc",     // OpenSSH format, ssh-keygen -Z aes128-cbc
+	"hostkey_ecdsa_pem",   // ssh-keygen -m PEM
+}
+
+func TestEncryptedHostKeys(t *testing.T) {
+	defer func(saved []byte) { hostKeyPassphrase = saved }(hostKeyPassphrase)
+	for _, name := range encryptedHostKeys {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubData, err := ioutil.ReadFile(filepath.Join("testdata", name+".pub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEncryptedKey(data) {
+			t.Errorf("%s: not seen as encrypted", name)
+		}
+
+		hostKeyPassphrase = nil
+		if _, err := parseHostKey(data); err != ErrNoPassphrase {
+			t.Errorf("%s: without passphrase got %v, want %v", name, err, ErrNoPassphrase)
+		}
+		hostKeyPassphrase = []byte("wrong")
+		if _, err := parseHostKey(data); err == nil {
+			t.Errorf("%s: wrong passphrase accepted", name)
+		}
+		hostKeyPassphrase = []byte("passphrase")
+		signer, err := parseHostKey(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			t.Errorf("%s: decrypted to a different key", name)
+		}
+	}
+}
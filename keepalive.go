@@ -0,0 +1,59 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Dead client detection like ClientAliveInterval and ClientAliveCountMax.
+package main
+
+import (
+	"time"
+)
+
+// Every `client_alive_interval` seconds (default 60, 0 disables) send a
+// keepalive@openssh.com with want-reply. The connection is closed when
+// `client_alive_count_max` (default 3) of them are unanswered.
+func (conn *ServerConn) keepAlive(done <-chan struct{}) {
+	interval := conf.getInt("client_alive_interval", 60)
+	if interval <= 0 {
+		return
+	}
+	max := conf.getInt("client_alive_count_max", 3)
+	tick := time.NewTicker(time.Duration(interval) * time.Second)
+	defer tick.Stop()
+	replies := make(chan struct{}, 1)
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-replies:
+			missed = 0
+		case <-tick.C:
+			if missed >= max {
+				conn.audit("closing, %d keepalives unanswered", missed)
+				conn.Close()
+				return
+			}
+			missed++
+			go func() {
+				// Any reply will do, failure included.
+				if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					select {
+					case replies <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}
+}
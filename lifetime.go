@@ -0,0 +1,208 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Idle timeouts and maximum lifetimes, all per-user files in seconds:
+// `idle_timeout` for no channel traffic in either direction,
+// `max_connection_time` for the whole connection and `max_exec_time` for
+// each exec command. Pty sessions are warned `timeout_warning` seconds
+// (default 60) before the connection goes.
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// A channel recording its traffic as activity of the connection.
+type activityChannel struct {
+	ssh.Channel
+	conn *ServerConn
+}
+
+func (conn *ServerConn) trackActivity(ch ssh.Channel) ssh.Channel {
+	return &activityChannel{ch, conn}
+}
+
+func (conn *ServerConn) touch() {
+	atomic.StoreInt64(&conn.active, time.Now().UnixNano())
+}
+
+func (conn *ServerConn) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.active))
+}
+
+func (c *activityChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	if n > 0 {
+		c.conn.touch()
+	}
+	return n, err
+}
+
+func (c *activityChannel) Write(b []byte) (int, error) {
+	c.conn.touch()
+	return c.Channel.Write(b)
+}
+
+func (c *activityChannel) Stderr() io.ReadWriter {
+	return &activityStream{c.Channel.Stderr(), c.conn}
+}
+
+type activityStream struct {
+	io.ReadWriter
+	conn *ServerConn
+}
+
+func (s *activityStream) Read(b []byte) (int, error) {
+	n, err := s.ReadWriter.Read(b)
+	if n > 0 {
+		s.conn.touch()
+	}
+	return n, err
+}
+
+func (s *activityStream) Write(b []byte) (int, error) {
+	s.conn.touch()
+	return s.ReadWriter.Write(b)
+}
+
+// Tell the user of a session something, without it counting as activity.
+// Pty sessions get it on the terminal, others on stderr.
+func (ch *Channel) notify(msg string) {
+	// A stalled client must not hold up everyone waiting for the lock.
+	lock.Lock()
+	raw := ch.ch
+	lock.Unlock()
+	if raw == nil {
+		return
+	}
+	if ac, ok := raw.(*activityChannel); ok {
+		raw = ac.Channel
+	}
+	if ch.pty != nil {
+		raw.Write([]byte(msg))
+	} else {
+		raw.Stderr().Write([]byte(msg))
+	}
+}
+
+func (conn *ServerConn) addSession(ch *Channel) {
+	conn.sessLock.Lock()
+	if conn.sessions == nil {
+		conn.sessions = make(map[*Channel]bool)
+	}
+	conn.sessions[ch] = true
+	conn.sessLock.Unlock()
+}
+
+func (conn *ServerConn) removeSession(ch *Channel) {
+	conn.sessLock.Lock()
+	delete(conn.sessions, ch)
+	conn.sessLock.Unlock()
+}
+
+// Write msg to the connection's pty sessions, or all sessions.
+func (conn *ServerConn) notifySessions(msg string, ptyOnly bool) {
+	conn.sessLock.Lock()
+	list := make([]*Channel, 0, len(conn.sessions))
+	for ch := range conn.sessions {
+		list = append(list, ch)
+	}
+	conn.sessLock.Unlock()
+	for _, ch := range list {
+		if !ptyOnly || ch.pty != nil {
+			ch.notify(msg)
+		}
+	}
+}
+
+// Close the connection, telling the sessions why. Their processes are
+// terminated as the session channels go away.
+func (conn *ServerConn) disconnect(reason string) {
+	conn.audit("disconnecting: %s", reason)
+	conn.notifySessions(fmt.Sprintf("\r\n[sshdog: disconnecting: %s]\r\n", reason), false)
+	conn.Close()
+}
+
+func (conn *ServerConn) userSeconds(name string) time.Duration {
+	return time.Duration(conf.getUserInt(conn.authUser(), name, 0)) * time.Second
+}
+
+// Enforce `idle_timeout` and `max_connection_time` until done.
+func (conn *ServerConn) enforceLimits(done <-chan struct{}) {
+	idle := conn.userSeconds("idle_timeout")
+	lifetime := conn.userSeconds("max_connection_time")
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+	warning := time.Duration(conf.getUserInt(conn.authUser(), "timeout_warning", 60)) * time.Second
+	start := time.Now()
+	var warnedIdle time.Time
+	warnedLifetime := false
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-tick.C:
+			if lifetime > 0 {
+				left := start.Add(lifetime).Sub(now)
+				if left <= 0 {
+					conn.disconnect(fmt.Sprintf("maximum connection time of %v reached", lifetime))
+					return
+				}
+				if left <= warning && !warnedLifetime {
+					warnedLifetime = true
+					conn.notifySessions(fmt.Sprintf("\r\n[sshdog: maximum connection time reached in %v]\r\n", left.Round(time.Second)), true)
+				}
+			}
+			if idle > 0 {
+				last := conn.idleSince()
+				left := last.Add(idle).Sub(now)
+				if left <= 0 {
+					conn.disconnect(fmt.Sprintf("idle for %v", idle))
+					return
+				}
+				if left <= warning && !warnedIdle.Equal(last) {
+					warnedIdle = last
+					conn.notifySessions(fmt.Sprintf("\r\n[sshdog: idle, disconnecting in %v]\r\n", left.Round(time.Second)), true)
+				}
+			}
+		}
+	}
+}
+
+// Stop the exec command of the channel after `max_exec_time`.
+func (ch *Channel) limitExec() {
+	max := ch.conn.userSeconds("max_exec_time")
+	if max <= 0 || ch.exe == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ch.exited:
+		case <-time.After(max):
+			ch.conn.audit("stopping %v after max_exec_time %v", ch.exe.Args, max)
+			ch.notify(fmt.Sprintf("\r\n[sshdog: command stopped after maximum time of %v]\r\n", max))
+			lock.Lock()
+			ch.exitStatus = 124
+			lock.Unlock()
+			ch.stopProcess()
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The `banner` sent before authentication and the `motd` shown when a
+// shell starts. Both may use $hostname, $remote, $user, $version and
+// $date, the motd also $last_login, kept in the `lastlog` state file.
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lastlogFile = "lastlog"
+
+var lastlogLock sync.Mutex
+
+// Expand the template variables in text, leaving unknown ones alone.
+func expandMessage(text string, meta ssh.ConnMetadata, extra map[string]string) string {
+	return os.Expand(text, func(name string) string {
+		switch name {
+		case "hostname":
+			host, _ := os.Hostname()
+			return host
+		case "remote":
+			return meta.RemoteAddr().String()
+		case "user":
+			return meta.User()
+		case "version":
+			return version
+		case "date":
+			return time.Now().Format(time.RFC1123)
+		}
+		if v, ok := extra[name]; ok {
+			return v
+		}
+		return "$" + name
+	})
+}
+
+// ServerConfig.BannerCallback, the user is known already so the banner
+// may be per-user. It comes before authentication, so unlike the other
+// settings it goes by the name the client sent.
+func (s *Server) banner(meta ssh.ConnMetadata) string {
+	data, err := conf.getUserBytes(meta.User(), "banner")
+	if err != nil {
+		return ""
+	}
+	return expandMessage(string(data), meta, nil)
+}
+
+// Record this login and, like OpenSSH, show the motd only when the shell
+// has a terminal, so it can't end up in piped output.
+func (conn *ServerConn) showMotd(ch *Channel) {
+	last := conn.recordLogin()
+	if ch.pty == nil {
+		return
+	}
+	data, err := conf.getUserBytes(conn.authUser(), "motd")
+	if err != nil {
+		return
+	}
+	msg := expandMessage(string(data), conn, map[string]string{"last_login": last})
+	msg = strings.Replace(strings.Replace(msg, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	ch.ch.Write([]byte(msg))
+}
+
+// Replace the user's line in `lastlog` by this login, returning the
+// previous one as "<time> from <address>".
+func (conn *ServerConn) recordLogin() string {
+	lastlogLock.Lock()
+	defer lastlogLock.Unlock()
+	lines, _ := conf.getLines(lastlogFile)
+	last := "never"
+	kept := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 3 && fields[0] == conn.authUser() {
+			last = fields[1] + " from " + fields[2]
+			continue
+		}
+		kept = append(kept, line)
+	}
+	kept = append(kept, fmt.Sprintf("%s\t%s\t%s", conn.authUser(), time.Now().Format(time.RFC1123), conn.RemoteAddr()))
+
+	// Write aside and rename so a crash doesn't lose everyone's entry.
+	path := conf.getPath(lastlogFile)
+	tmp := path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		dbg.Debug("Unable to write %s: %v", lastlogFile, err)
+		return last
+	}
+	_, err = fp.WriteString(strings.Join(kept, "\n") + "\n")
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		dbg.Debug("Unable to write %s: %v", lastlogFile, err)
+		os.Remove(tmp)
+	}
+	return last
+}
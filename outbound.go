@@ -0,0 +1,150 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Where forwarded connections come from.
+// Each line of the `outbound` file is host:port followed by settings for
+// destinations matching it (same syntax as permit_open, see permit.go);
+// the first matching line is used:
+//
+//	10.1.0.0/16:* netns=/run/netns/data device=vrf-data
+//	*:* source=192.0.2.10 timeout=5
+//
+// netns is a network namespace file, device an interface or VRF to bind
+// to, source the local address and timeout the dial timeout in seconds.
+// A name is looked up with the netns and device of the first line that
+// matches the name itself, lines by address then apply to the addresses
+// it resolves to.
+// proxy sends the connection through an upstream proxy, see proxy.go;
+// the other settings then apply to reaching the proxy, which also gets
+// the name to resolve.
+package main
+
+import (
+	"fmt"
+	"github.com/hengwu0/sshdog/proc"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How to reach one destination.
+type outboundRoute struct {
+	proc.Dialer
+	proxy *upstreamProxy
+}
+
+func (r *outboundRoute) String() string {
+	s := fmt.Sprintf("netns=%q device=%q source=%v timeout=%v", r.Netns, r.Device, r.Source, r.Timeout)
+	if r.proxy != nil {
+		s += " proxy=" + r.proxy.scheme + "://" + r.proxy.addr
+	}
+	return s
+}
+
+func (r *outboundRoute) dial(network, address string) (net.Conn, error) {
+	if r.proxy != nil && network != "tcp" {
+		return nil, ErrProxyNetwork
+	}
+	if r.proxy != nil {
+		return r.proxy.Dial(r.Dialer.Dial, address, r.Timeout)
+	}
+	return r.Dialer.Dial(network, address)
+}
+
+// Settings for connecting to host, resolved to ip (nil when it could not
+// be resolved here), on port.
+func (conn *ServerConn) outboundRoute(host string, ip net.IP, port int) (*outboundRoute, error) {
+	d := &outboundRoute{}
+	d.Timeout = time.Duration(conf.getInt("dial_timeout", 30)) * time.Second
+	lines, err := conf.getUserLines(conn.authUser(), "outbound")
+	if err != nil {
+		return d, nil
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		rule, err := parsePermitRule(fields[0])
+		if err != nil || rule.deny {
+			return nil, fmt.Errorf("bad outbound rule %q", line)
+		}
+		if !rule.match(host, ip, port) {
+			continue
+		}
+		for _, setting := range fields[1:] {
+			name, value := splitEnv(setting)
+			switch name {
+			case "netns":
+				d.Netns = value
+			case "device":
+				d.Device = value
+			case "source":
+				if d.Source = net.ParseIP(value); d.Source == nil {
+					return nil, fmt.Errorf("bad outbound source %q", value)
+				}
+			case "timeout":
+				seconds, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("bad outbound timeout %q", value)
+				}
+				d.Timeout = time.Duration(seconds) * time.Second
+			case "proxy":
+				if d.proxy, err = parseProxy(value); err != nil {
+					return nil, fmt.Errorf("bad outbound proxy %q: %v", value, err)
+				}
+			default:
+				return nil, fmt.Errorf("unknown outbound setting %q", setting)
+			}
+		}
+		break
+	}
+	return d, nil
+}
+
+// Addresses of host for connecting to port, see above. No addresses and
+// no error means a proxy takes the name as it is.
+func (conn *ServerConn) lookupDest(host string, port int) ([]net.IP, error) {
+	route, err := conn.outboundRoute(host, nil, port)
+	if err != nil {
+		return nil, err
+	}
+	if route.proxy != nil {
+		return nil, nil
+	}
+	return route.LookupIP(host)
+}
+
+// Connect to the first reachable address of host. Without addresses the
+// name itself is used, which only a proxy can make work.
+func (conn *ServerConn) dialForward(network, host string, ips []net.IP, port int) (net.Conn, error) {
+	if len(ips) == 0 {
+		route, err := conn.outboundRoute(host, nil, port)
+		if err != nil {
+			return nil, err
+		}
+		return route.dial(network, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	var err error
+	for _, ip := range ips {
+		var route *outboundRoute
+		if route, err = conn.outboundRoute(host, ip, port); err != nil {
+			return nil, err
+		}
+		var c net.Conn
+		if c, err = route.dial(network, net.JoinHostPort(ip.String(), strconv.Itoa(port))); err == nil {
+			return c, nil
+		}
+		dbg.Debug("Unable to dial %s via %v: %v", ip, route, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Port forwarding rules, like OpenSSH's PermitOpen and PermitListen.
+// `permit_open` governs direct-tcpip destinations, `permit_listen` the
+// addresses of tcpip-forward. Each line is [!]host:port, the first
+// matching line decides and '!' denies. Without the file everything is
+// allowed, with it whatever matches no line is denied.
+//
+// host is a wildcard pattern for names and addresses, a CIDR, or one of
+// the keywords loopback, linklocal and private. IPv6 goes in brackets.
+// port is a number, a range like 8000-8999 or '*'. Ports below 1024 can
+// only be listened on when the line allowing it has a number or range.
+//
+//	!loopback:*
+//	!linklocal:*
+//	10.0.0.0/8:22
+//	*.example.com:443
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrForwardDenied = errors.New("Port forwarding denied by policy.")
+	ErrBadRule       = errors.New("Bad forwarding rule.")
+	ErrPrivileged    = errors.New("Ports below 1024 must be listed in permit_listen.")
+)
+
+type permitRule struct {
+	deny    bool
+	pattern string     // wildcard pattern, "" when network or keyword is used
+	network *net.IPNet // CIDR
+	keyword string
+	low     int
+	high    int
+	anyPort bool // '*'
+}
+
+func parsePermitRule(line string) (*permitRule, error) {
+	r := &permitRule{}
+	if strings.HasPrefix(line, "!") {
+		r.deny = true
+		line = line[1:]
+	}
+	var host, port string
+	if strings.HasPrefix(line, "[") {
+		end := strings.Index(line, "]")
+		if end < 0 || !strings.HasPrefix(line[end+1:], ":") {
+			return nil, ErrBadRule
+		}
+		host, port = line[1:end], line[end+2:]
+	} else {
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return nil, ErrBadRule
+		}
+		host, port = line[:i], line[i+1:]
+	}
+
+	switch {
+	case host == "loopback", host == "linklocal", host == "private":
+		r.keyword = host
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		r.network = network
+	case host == "":
+		return nil, ErrBadRule
+	default:
+		r.pattern = strings.ToLower(host)
+	}
+
+	if port == "*" {
+		r.low, r.high, r.anyPort = 0, 65535, true
+		return r, nil
+	}
+	low, high := port, port
+	if i := strings.Index(port, "-"); i >= 0 {
+		low, high = port[:i], port[i+1:]
+	}
+	var err error
+	if r.low, err = strconv.Atoi(low); err != nil {
+		return nil, ErrBadRule
+	}
+	if r.high, err = strconv.Atoi(high); err != nil {
+		return nil, ErrBadRule
+	}
+	if r.low < 0 || r.high > 65535 || r.low > r.high {
+		return nil, ErrBadRule
+	}
+	return r, nil
+}
+
+// Whether the rule applies to host, resolved to ip (may be nil), and port.
+func (r *permitRule) match(host string, ip net.IP, port int) bool {
+	if port < r.low || port > r.high {
+		return false
+	}
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.keyword == "loopback":
+		return ip != nil && ip.IsLoopback()
+	case r.keyword == "linklocal":
+		return ip != nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast())
+	case r.keyword == "private":
+		return ip != nil && isPrivate(ip)
+	}
+	if wildcardMatch(r.pattern, strings.ToLower(host)) {
+		return true
+	}
+	return ip != nil && wildcardMatch(r.pattern, ip.String())
+}
+
+// RFC 1918 and RFC 4193 networks, what the private keyword matches.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The user's rules from file, nil if there are none.
+func (conn *ServerConn) permitRules(file string) ([]*permitRule, error) {
+	lines, err := conf.getUserLines(conn.authUser(), file)
+	if err != nil {
+		return nil, nil
+	}
+	rules := make([]*permitRule, 0, len(lines))
+	for _, line := range lines {
+		r, err := parsePermitRule(line)
+		if err != nil {
+			dbg.Debug("Bad rule %q in %s: %v", line, file, err)
+			// A broken file must not end up allowing everything.
+			return nil, ErrForwardDenied
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func permitted(rules []*permitRule, host string, ip net.IP, port int) bool {
+	for _, r := range rules {
+		if r.match(host, ip, port) {
+			return !r.deny
+		}
+	}
+	return false
+}
+
+// Like OpenSSH, which keeps ports below 1024 for root, a client may only
+// listen there when the permit_listen line allowing it names the port.
+func (conn *ServerConn) privilegedListenAllowed(host string, ip net.IP, port int) bool {
+	rules, err := conn.permitRules("permit_listen")
+	if err != nil {
+		return false
+	}
+	for _, r := range rules {
+		if r.match(host, ip, port) {
+			return !r.deny && !r.anyPort
+		}
+	}
+	return false
+}
+
+// Addresses of host in the daemon's own network namespace, where
+// tcpip-forward listens.
+func lookupLocal(host string, port int) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+// Addresses of host that may be used for port under the rules in file.
+// Names are resolved here with lookup and the caller uses the result, so
+// a name can't be used to reach an address the rules deny. When lookup
+// gives no addresses and no error, a proxy resolves the name and only
+// the name can be checked; the result is then empty too.
+func (conn *ServerConn) permittedAddrs(file, host string, port int, lookup func(string, int) ([]net.IP, error)) ([]net.IP, error) {
+	rules, err := conn.permitRules(file)
+	if err != nil {
+		conn.audit("rejected %s to %s: %v", file, net.JoinHostPort(host, strconv.Itoa(port)), err)
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = lookup(host, port); err != nil {
+		// Rules can't be checked without addresses, without rules
+		// this is just a name that doesn't resolve.
+		if rules != nil {
+			conn.audit("rejected %s to %s: %v", file, net.JoinHostPort(host, strconv.Itoa(port)), err)
+			return nil, ErrForwardDenied
+		}
+		return nil, err
+	} else if len(ips) == 0 {
+		if rules != nil && !permitted(rules, host, nil, port) {
+			conn.audit("rejected %s to %s", file, net.JoinHostPort(host, strconv.Itoa(port)))
+			return nil, ErrForwardDenied
+		}
+		return nil, nil
+	}
+	if rules == nil {
+		return ips, nil
+	}
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if permitted(rules, host, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		conn.audit("rejected %s to %s", file, net.JoinHostPort(host, strconv.Itoa(port)))
+		return nil, ErrForwardDenied
+	}
+	return allowed, nil
+}
@@ -0,0 +1,398 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Detachable pty sessions, a tiny built-in screen/tmux.
+// A client asks for one with `exec sshdog-attach <name>` or by sending
+// SSHDOG_SESSION=<name> before `shell`. The shell and its pty then outlive
+// the connection and can be attached again by the same user.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/hengwu0/sshdog/proc"
+	"github.com/hengwu0/sshdog/pty"
+	"io"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	persistAttachCmd = "sshdog-attach"
+	persistEnv       = "SSHDOG_SESSION"
+)
+
+var (
+	ErrPersistNoPty = errors.New("Detachable sessions need a pty (ssh -t).")
+	ErrPersistLimit = errors.New("Too many detachable sessions.")
+	ErrPersistName  = errors.New("Session names may only use letters, digits, '.', '_' and '-'.")
+)
+
+type persistSession struct {
+	name     string
+	user     string
+	pty      *pty.Pty
+	exe      *exec.Cmd
+	created  time.Time
+	detached time.Time
+	watched  *watchedSession
+	cgroup   string
+
+	mu     sync.Mutex
+	scroll *ringBuffer
+	client *Channel
+	out    *queuedWriter
+}
+
+var persistLock sync.Mutex
+var persistSessions = make(map[string]*persistSession)
+
+func persistKey(user, name string) string {
+	return user + "\x00" + name
+}
+
+// Sessions owned by user, sorted by name.
+func persistList(user string) []*persistSession {
+	persistLock.Lock()
+	defer persistLock.Unlock()
+	list := make([]*persistSession, 0, len(persistSessions))
+	for _, ps := range persistSessions {
+		if ps.user == user {
+			list = append(list, ps)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Print the user's sessions to the channel.
+func (conn *ServerConn) listPersistent(w io.Writer) {
+	list := persistList(conn.authUser())
+	if len(list) == 0 {
+		fmt.Fprintf(w, "No sessions.\r\n")
+		return
+	}
+	for _, ps := range list {
+		state := "attached"
+		ps.mu.Lock()
+		if ps.client == nil {
+			state = "detached since " + ps.detached.Format(time.RFC3339)
+		}
+		ps.mu.Unlock()
+		fmt.Fprintf(w, "%s\tpid %d\tcreated %s\t%s\r\n",
+			ps.name, ps.exe.Process.Pid, ps.created.Format(time.RFC3339), state)
+	}
+}
+
+// Attach the channel to the named session, starting it if needed.
+func (conn *ServerConn) attachPersistent(ch *Channel, name string) error {
+	if ch.pty == nil {
+		return ErrPersistNoPty
+	}
+	if !validPersistName(name) {
+		return ErrPersistName
+	}
+	user := conn.authUser()
+	key := persistKey(user, name)
+
+	persistLock.Lock()
+	ps, ok := persistSessions[key]
+	if !ok {
+		count := 0
+		for _, other := range persistSessions {
+			if other.user == user {
+				count++
+			}
+		}
+		if count >= conf.getInt("max_persistent", 8) {
+			persistLock.Unlock()
+			return ErrPersistLimit
+		}
+		ps = &persistSession{
+			name:    name,
+			user:    user,
+			pty:     ch.pty,
+			created: time.Now(),
+			scroll:  newRingBuffer(conf.getInt("scrollback", 64*1024)),
+		}
+		if err := ps.start(ch); err != nil {
+			persistLock.Unlock()
+			return err
+		}
+		persistSessions[key] = ps
+	}
+	persistLock.Unlock()
+
+	if ok {
+		dbg.Debug("Reattaching session %s of %s.", name, user)
+		ch.pty.Close()
+		ch.pty = ps.pty
+	} else {
+		dbg.Debug("Started session %s of %s.", name, user)
+	}
+	ch.persist = ps
+	ps.attach(ch, ok)
+	if ch.rows != 0 && ch.cols != 0 {
+		// SIGWINCH makes full screen programs redraw.
+		ps.pty.Resize(ch.rows, ch.cols, 0, 0)
+	}
+	return nil
+}
+
+func validPersistName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Start the shell of a new session on the channel's pty.
+func (ps *persistSession) start(ch *Channel) error {
+	ch.environ = setEnv(ch.environ, persistEnv, ps.name)
+	exe := ch.command(defaultShell())
+	ps.pty.AttachTty(exe)
+	proc.SetProcessGroup(exe)
+	cgroup, err := ch.confine(exe)
+	if err != nil {
+		ps.pty.CloseTTY()
+		return err
+	}
+	proc.Setuid(conf.fileExists("setuid"))
+	err = exe.Start()
+	ps.pty.CloseTTY()
+	if err != nil {
+		proc.RemoveCgroup(cgroup)
+		return err
+	}
+	ps.cgroup = cgroup
+	ps.exe = exe
+	ps.watched = ch.conn.registerWatched(ps.pty)
+	ps.pty.AttachIO(ps, nil)
+	go ps.wait()
+	return nil
+}
+
+func (ps *persistSession) wait() {
+	if err := ps.exe.Wait(); err != nil {
+		dbg.Debug("session %s exited(%s)", ps.name, err)
+	}
+	ps.pty.WaitIO(time.Second)
+	ps.watched.unregister()
+	persistLock.Lock()
+	delete(persistSessions, persistKey(ps.user, ps.name))
+	persistLock.Unlock()
+
+	ps.mu.Lock()
+	client, out := ps.client, ps.out
+	ps.client, ps.out = nil, nil
+	ps.mu.Unlock()
+	if out != nil {
+		out.stop()
+	}
+	if client != nil {
+		client.Close()
+	}
+	ps.pty.Close()
+	proc.RemoveCgroup(ps.cgroup)
+	dbg.Debug("Session %s of %s finished.", ps.name, ps.user)
+}
+
+// Make ch the attached client, replaying the scrollback when resuming.
+// A client attached elsewhere is detached, so is one that stalls.
+func (ps *persistSession) attach(ch *Channel, replay bool) {
+	out := newQueuedWriter(ch.ch, persistStall, func() {
+		dbg.Debug("Client of session %s stalled, detaching.", ps.name)
+		ps.detach(ch)
+		ch.Close()
+	})
+	ps.mu.Lock()
+	old, oldOut := ps.client, ps.out
+	ps.client, ps.out = ch, out
+	if replay {
+		// The oldest bytes may be the middle of an escape sequence, so
+		// reset the terminal and start at a line.
+		scroll := ps.scroll.Bytes()
+		if ps.scroll.full {
+			if i := bytes.IndexByte(scroll, '\n'); i >= 0 {
+				scroll = scroll[i+1:]
+			}
+		}
+		out.Write(append([]byte("\x1bc"), scroll...))
+	}
+	ps.mu.Unlock()
+
+	if oldOut != nil {
+		oldOut.stop()
+	}
+	if old != nil && old != ch {
+		if old.ch != nil {
+			fmt.Fprintf(old.ch, "\r\n[%s: attached from elsewhere]\r\n", ps.name)
+		}
+		old.Close()
+	}
+	go io.Copy(ps.pty, ch.ch)
+}
+
+// Called when the channel goes away, the session keeps running.
+func (ps *persistSession) detach(ch *Channel) {
+	ps.mu.Lock()
+	var out *queuedWriter
+	if ps.client == ch {
+		out = ps.out
+		ps.client, ps.out = nil, nil
+		ps.detached = time.Now()
+		dbg.Debug("Detached session %s of %s.", ps.name, ps.user)
+	}
+	ps.mu.Unlock()
+	if out != nil {
+		out.stop()
+	}
+}
+
+// Output of the session's pty, kept for replay and passed to the client.
+func (ps *persistSession) Write(b []byte) (int, error) {
+	ps.mu.Lock()
+	ps.scroll.Write(b)
+	out := ps.out
+	ps.mu.Unlock()
+	if out != nil {
+		out.Write(b)
+	}
+	return len(b), nil
+}
+
+// How long the attached client may keep its window closed before it is
+// detached, the session goes on and its output collects in the scrollback.
+const persistStall = 10 * time.Second
+
+// Queue depth of a queuedWriter, in pty reads.
+const writeQueueLen = 64
+
+// A writer that doesn't hold up its caller on a stalled reader. Writes
+// are queued for a goroutine; when the queue stays full for longer than
+// stall, the writer stops and onStall is called.
+type queuedWriter struct {
+	queue   chan []byte
+	done    chan struct{}
+	once    sync.Once
+	stall   time.Duration
+	onStall func()
+}
+
+func newQueuedWriter(w io.Writer, stall time.Duration, onStall func()) *queuedWriter {
+	q := &queuedWriter{
+		queue:   make(chan []byte, writeQueueLen),
+		done:    make(chan struct{}),
+		stall:   stall,
+		onStall: onStall,
+	}
+	go func() {
+		for {
+			select {
+			case b := <-q.queue:
+				if _, err := w.Write(b); err != nil {
+					q.stop()
+					return
+				}
+			case <-q.done:
+				return
+			}
+		}
+	}()
+	return q
+}
+
+func (q *queuedWriter) Write(b []byte) (int, error) {
+	b = append([]byte(nil), b...)
+	select {
+	case <-q.done:
+		return 0, io.ErrClosedPipe
+	case q.queue <- b:
+		return len(b), nil
+	default:
+	}
+	if q.stall > 0 {
+		t := time.NewTimer(q.stall)
+		defer t.Stop()
+		select {
+		case <-q.done:
+			return 0, io.ErrClosedPipe
+		case q.queue <- b:
+			return len(b), nil
+		case <-t.C:
+		}
+	}
+	q.once.Do(func() {
+		close(q.done)
+		go q.onStall()
+	})
+	return 0, io.ErrClosedPipe
+}
+
+// Stop the goroutine, dropping what is still queued.
+func (q *queuedWriter) stop() {
+	q.once.Do(func() { close(q.done) })
+}
+
+// Fixed size buffer keeping the last bytes written.
+type ringBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(b []byte) (int, error) {
+	n := len(b)
+	if n >= len(r.buf) {
+		copy(r.buf, b[n-len(r.buf):])
+		r.pos, r.full = 0, true
+		return n, nil
+	}
+	c := copy(r.buf[r.pos:], b)
+	if c < n {
+		copy(r.buf, b[c:])
+		r.full = true
+	}
+	r.pos = (r.pos + n) % len(r.buf)
+	if r.pos == 0 {
+		r.full = true
+	}
+	return n, nil
+}
+
+// Buffered content, oldest first.
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return append([]byte{}, r.buf[:r.pos]...)
+	}
+	return append(append([]byte{}, r.buf[r.pos:]...), r.buf[:r.pos]...)
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command policy for shell and exec requests, plus the audit log.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/shlex"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCommandNotAllowed = errors.New("Command not allowed.")
+	ErrCommandPolicy     = errors.New("Command denied by policy.")
+)
+
+// The user's `force_command`, "" if none.
+func (conn *ServerConn) forcedCommand() string {
+	force, err := conf.getUserBytes(conn.authUser(), "force_command")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(force))
+}
+
+// Work out what really runs for a request, cmd is "" for a shell.
+// A `force_command` replaces whatever the client asked for, otherwise the
+// command must match `allowed_commands` (when present) and be approved by
+// the `command_policy` program (when present).
+func (conn *ServerConn) checkCommand(cmd string) (string, error) {
+	user := conn.authUser()
+	checked := false
+	if forced := conn.forcedCommand(); forced != "" {
+		conn.audit("force_command %q instead of %q", forced, cmd)
+		return forced, nil
+	}
+
+	if patterns, err := conf.getUserLines(user, "allowed_commands"); err == nil {
+		checked = true
+		allowed := false
+		for _, pattern := range patterns {
+			if cmd != "" && wildcardMatch(pattern, cmd) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			conn.audit("rejected %q: not in allowed_commands", cmd)
+			return "", ErrCommandNotAllowed
+		}
+	}
+
+	if policy, err := conf.getUserBytes(user, "command_policy"); err == nil {
+		if program := strings.TrimSpace(string(policy)); program != "" {
+			checked = true
+			if err := conn.runPolicy(program, cmd); err != nil {
+				conn.audit("rejected %q: command_policy %s: %v", cmd, program, err)
+				return "", ErrCommandPolicy
+			}
+		}
+	}
+	if checked {
+		conn.audit("accepted %q", cmd)
+	}
+	return cmd, nil
+}
+
+// Ask the external policy program, exit status 0 approves.
+// The request is passed in the environment.
+func (conn *ServerConn) runPolicy(program, cmd string) error {
+	policy := exec.Command(program)
+	policy.Env = conn.loginEnviron(sessionEnviron())
+	policy.Env = setEnv(policy.Env, "SSH_ORIGINAL_COMMAND", cmd)
+	if cmd == "" {
+		policy.Env = setEnv(policy.Env, "SSHDOG_REQUEST", "shell")
+	} else {
+		policy.Env = setEnv(policy.Env, "SSHDOG_REQUEST", "exec")
+	}
+	return policy.Run()
+}
+
+// Arguments to execute cmd with. Users with an `exec_direct` file get the
+// command split into argv and run without a shell.
+func (conn *ServerConn) commandArgv(cmd string) ([]string, error) {
+	if cmd == "" {
+		return defaultShell(), nil
+	}
+	if conf.userFileExists(conn.authUser(), "exec_direct") {
+		argv, err := shlex.Split(cmd)
+		if err != nil {
+			return nil, err
+		}
+		if len(argv) == 0 {
+			return nil, ErrCommandNotAllowed
+		}
+		return argv, nil
+	}
+	return commandWithShell(cmd), nil
+}
+
+// Shell-style match where '*' also matches '/' and spaces.
+// Iterative with a single backtrack point, so it stays linear in the
+// length of s for any number of '*'.
+func wildcardMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, retry := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]) && pattern[p] != '*':
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			// Try matching nothing first, remember where to retry.
+			star, retry = p, i
+			p++
+		case star >= 0:
+			retry++
+			p, i = star+1, retry
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+var auditLock sync.Mutex
+
+// Append a line to the `audit.log` file in the config dir.
+func (conn *ServerConn) audit(format string, args ...interface{}) {
+	auditConn(conn, format, args...)
+}
+
+// Audit before there is a ServerConn, during authentication.
+func auditConn(conn ssh.ConnMetadata, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	dbg.Debug("audit: %s", msg)
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	fp, err := os.OpenFile(conf.getPath("audit.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		dbg.Debug("Unable to write audit log: %v", err)
+		return
+	}
+	defer fp.Close()
+	fmt.Fprintf(fp, "%s %s@%s %s\n", time.Now().Format(time.RFC3339), conn.User(), conn.RemoteAddr(), msg)
+}
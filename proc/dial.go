@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Outbound connections for port forwarding.
+
+package proc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where and how forwarded connections are made.
+type Dialer struct {
+	Netns   string // network namespace file, like /run/netns/NAME
+	Device  string // interface or VRF for SO_BINDTODEVICE
+	Source  net.IP
+	Timeout time.Duration
+}
+
+func (d *Dialer) dialer(network string) *net.Dialer {
+	nd := &net.Dialer{Timeout: d.Timeout}
+	if d.Source != nil {
+		if strings.HasPrefix(network, "udp") {
+			nd.LocalAddr = &net.UDPAddr{IP: d.Source}
+		} else {
+			nd.LocalAddr = &net.TCPAddr{IP: d.Source}
+		}
+	}
+	return nd
+}
+
+// Addresses of host, asking DNS from the namespace and device the
+// connection is made in. Like ip netns exec, a namespace /run/netns/NAME
+// uses the nameserver in /etc/netns/NAME/resolv.conf when there is one.
+func (d *Dialer) LookupIP(host string) ([]net.IP, error) {
+	if d.Netns == "" && d.Device == "" {
+		return net.LookupIP(host)
+	}
+	dns := &Dialer{Netns: d.Netns, Device: d.Device, Timeout: d.Timeout}
+	server := ""
+	if d.Netns != "" {
+		server = netnsNameserver(filepath.Join("/etc/netns", filepath.Base(d.Netns), "resolv.conf"))
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if server != "" {
+				address = net.JoinHostPort(server, "53")
+			}
+			return dns.Dial(network, address)
+		},
+	}
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// The first nameserver of a resolv.conf, "" if none.
+func netnsNameserver(path string) string {
+	fp, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			return fields[1]
+		}
+	}
+	return ""
+}
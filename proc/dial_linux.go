@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A socket belongs to the network namespace of the thread creating it, so
+// the dial happens on a locked thread switched into the namespace and back.
+
+package proc
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	nd := d.dialer(network)
+	if d.Device != "" {
+		nd.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, d.Device)
+			})
+			if err != nil {
+				return fmt.Errorf("bind to %s: %v", d.Device, err)
+			}
+			return nil
+		}
+	}
+	if d.Netns == "" {
+		return nd.Dial(network, address)
+	}
+
+	target, err := os.Open(d.Netns)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	defer self.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("setns %s: %v", d.Netns, err)
+	}
+	c, err := nd.Dial(network, address)
+	if unix.Setns(int(self.Fd()), unix.CLONE_NEWNET) == nil {
+		runtime.UnlockOSThread()
+	}
+	// Otherwise the thread stays locked and exits with the goroutine.
+	return c, err
+}
@@ -0,0 +1,27 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"errors"
+	"net"
+)
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	if d.Netns != "" || d.Device != "" {
+		return nil, errors.New("Network namespaces and devices are not supported.")
+	}
+	return d.dialer(network).Dial(network, address)
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Enter the namespaces of a running process, like `nsenter -t PID -a`.
+//
+// A Go process is always multithreaded, so the mount and user namespaces
+// can't be joined with setns(2). The wrapper chroots into /proc/PID/root
+// instead, which gives the same view of the file system (`nsenter -r`).
+// The pid namespace only applies to children, so the wrapper forks the
+// command and waits for it.
+
+package proc
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Namespaces joined with setns, in this order.
+var enterNamespaces = []struct {
+	name string
+	flag int
+}{
+	{"cgroup", unix.CLONE_NEWCGROUP},
+	{"ipc", unix.CLONE_NEWIPC},
+	{"uts", unix.CLONE_NEWUTS},
+	{"net", unix.CLONE_NEWNET},
+	{"pid", unix.CLONE_NEWPID},
+}
+
+// Have the exec wrapper start cmd inside the namespaces of pid.
+func ApplyEnter(cmd *exec.Cmd, pid int) error {
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d/ns", pid)); err != nil {
+		return fmt.Errorf("no process %d: %v", pid, err)
+	}
+	wrap(cmd, "enter="+strconv.Itoa(pid))
+	return nil
+}
+
+// First process of a cgroup, to enter a container by its cgroup path.
+func CgroupPid(dir string) (int, error) {
+	fp, err := os.Open(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		if pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text())); err == nil && pid > 0 {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process in cgroup %s", dir)
+}
+
+// Runs in the wrapper: join the namespaces, cgroup and root of pid.
+func enterProcess(pid int) error {
+	proc := fmt.Sprintf("/proc/%d", pid)
+	root, err := os.Open(filepath.Join(proc, "root"))
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	self := fmt.Sprintf("/proc/%d", os.Getpid())
+	fds := make([]*os.File, 0, len(enterNamespaces))
+	flags := make([]int, 0, len(enterNamespaces))
+	for _, ns := range enterNamespaces {
+		// Skip namespaces we already share, setns may refuse them.
+		target, err := os.Readlink(filepath.Join(proc, "ns", ns.name))
+		if err != nil {
+			continue
+		}
+		if own, err := os.Readlink(filepath.Join(self, "ns", ns.name)); err == nil && own == target {
+			continue
+		}
+		fp, err := os.Open(filepath.Join(proc, "ns", ns.name))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		fds = append(fds, fp)
+		flags = append(flags, ns.flag)
+	}
+
+	joinProcessCgroup(proc)
+	for i, fp := range fds {
+		if err := unix.Setns(int(fp.Fd()), flags[i]); err != nil {
+			return fmt.Errorf("setns %s: %v", fp.Name(), err)
+		}
+	}
+	if err := unix.Fchdir(int(root.Fd())); err != nil {
+		return err
+	}
+	if err := unix.Chroot("."); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	return nil
+}
+
+// Best effort, move ourselves to the cgroups of the target.
+func joinProcessCgroup(proc string) {
+	fp, err := os.Open(filepath.Join(proc, "cgroup"))
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		// hierarchy-ID:controllers:path
+		f := strings.SplitN(scanner.Text(), ":", 3)
+		if len(f) != 3 {
+			continue
+		}
+		dir := "/sys/fs/cgroup"
+		if f[1] != "" {
+			dir = filepath.Join(dir, strings.TrimPrefix(f[1], "name="))
+		}
+		joinCgroup(filepath.Join(dir, f[2]))
+	}
+}
+
+// Run the command as a child, passing on signals and its exit status.
+func forkAndWait(path string, argv []string) error {
+	cmd := exec.Command(path)
+	cmd.Args = argv
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	cmd.Wait()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
+		}
+		os.Exit(ws.ExitStatus())
+	}
+	os.Exit(1)
+	return nil
+}
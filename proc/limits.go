@@ -0,0 +1,124 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Resource limits for session processes.
+
+package proc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Limits applied to a session process before it runs.
+// Zero values mean "leave alone".
+type Limits struct {
+	CPU       uint64 // seconds
+	AS        uint64 // bytes
+	NoFile    uint64
+	NProc     uint64
+	Nice      int
+	IOClass   int // 1 realtime, 2 best-effort, 3 idle
+	IOLevel   int
+	Cgroup    string // cgroup v2 directory the sessions are created under
+	MemoryMax string
+	PidsMax   string
+}
+
+// Parse `key value` lines:
+//
+//	cpu 60
+//	as 512M
+//	nofile 1024
+//	nproc 64
+//	nice 10
+//	ionice 2 7
+//	cgroup /sys/fs/cgroup/sshdog
+//	memory.max 256M
+//	pids.max 100
+func ParseLimits(lines []string) (*Limits, error) {
+	l := &Limits{}
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			return nil, fmt.Errorf("bad limit line: %q", line)
+		}
+		var err error
+		switch f[0] {
+		case "cpu":
+			l.CPU, err = parseSize(f[1])
+		case "as":
+			l.AS, err = parseSize(f[1])
+		case "nofile":
+			l.NoFile, err = parseSize(f[1])
+		case "nproc":
+			l.NProc, err = parseSize(f[1])
+		case "nice":
+			l.Nice, err = strconv.Atoi(f[1])
+		case "ionice":
+			if l.IOClass, err = strconv.Atoi(f[1]); err == nil && len(f) > 2 {
+				l.IOLevel, err = strconv.Atoi(f[2])
+			}
+		case "cgroup":
+			l.Cgroup = f[1]
+		case "memory.max":
+			l.MemoryMax = f[1]
+		case "pids.max":
+			l.PidsMax = f[1]
+		default:
+			err = fmt.Errorf("unknown limit %q", f[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Number with an optional K/M/G suffix.
+func parseSize(s string) (uint64, error) {
+	orig := s
+	mult := uint64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/mult {
+		return 0, fmt.Errorf("limit out of range: %q", orig)
+	}
+	return n * mult, nil
+}
+
+func (l *Limits) encode() string {
+	return fmt.Sprintf("%d,%d,%d,%d,%d,%d,%d", l.CPU, l.AS, l.NoFile, l.NProc, l.Nice, l.IOClass, l.IOLevel)
+}
+
+func decodeLimits(s string) (*Limits, error) {
+	l := &Limits{}
+	_, err := fmt.Sscanf(s, "%d,%d,%d,%d,%d,%d,%d", &l.CPU, &l.AS, &l.NoFile, &l.NProc, &l.Nice, &l.IOClass, &l.IOLevel)
+	return l, err
+}
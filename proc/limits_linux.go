@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// Have the exec wrapper apply l and join cgroup (when not "") before
+// exec'ing the real program.
+func ApplyLimits(cmd *exec.Cmd, l *Limits, cgroup string) {
+	wrap(cmd, "limits="+l.encode())
+	if cgroup != "" {
+		wrap(cmd, "cgroup="+cgroup)
+	}
+}
+
+func (l *Limits) apply() error {
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, l.CPU},
+		{unix.RLIMIT_AS, l.AS},
+		{unix.RLIMIT_NOFILE, l.NoFile},
+		{unix.RLIMIT_NPROC, l.NProc},
+	}
+	for _, r := range rlimits {
+		if r.value == 0 {
+			continue
+		}
+		if err := unix.Setrlimit(r.resource, &unix.Rlimit{Cur: r.value, Max: r.value}); err != nil {
+			return fmt.Errorf("setrlimit %d: %v", r.resource, err)
+		}
+	}
+	if l.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, l.Nice); err != nil {
+			return fmt.Errorf("nice: %v", err)
+		}
+	}
+	if l.IOClass != 0 {
+		prio := l.IOClass<<ioprioClassShift | l.IOLevel
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+			return fmt.Errorf("ionice: %v", errno)
+		}
+	}
+	return nil
+}
+
+var cgroupSeq uint32
+
+// Create a cgroup v2 directory for one session under l.Cgroup.
+func NewCgroup(l *Limits) (string, error) {
+	if l.Cgroup == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(l.Cgroup, 0755); err != nil {
+		return "", err
+	}
+	// Best effort, the parent may already delegate these.
+	ioutil.WriteFile(filepath.Join(l.Cgroup, "cgroup.subtree_control"), []byte("+memory +pids"), 0)
+
+	name := fmt.Sprintf("session-%d-%d", os.Getpid(), atomic.AddUint32(&cgroupSeq, 1))
+	dir := filepath.Join(l.Cgroup, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	for file, value := range map[string]string{"memory.max": l.MemoryMax, "pids.max": l.PidsMax} {
+		if value == "" {
+			continue
+		}
+		if n, err := parseSize(value); err == nil {
+			value = strconv.FormatUint(n, 10)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			os.Remove(dir)
+			return "", fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return dir, nil
+}
+
+// Kill what is left in the session cgroup and remove it.
+func RemoveCgroup(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"os/exec"
+)
+
+func ApplyLimits(cmd *exec.Cmd, l *Limits, cgroup string) {
+}
+
+func WrapperMain() {
+}
+
+func NewCgroup(l *Limits) (string, error) {
+	return "", nil
+}
+
+func RemoveCgroup(dir string) error {
+	return nil
+}
@@ -2,11 +2,14 @@ package proc
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -19,7 +22,7 @@ func Setuid(b bool) {
 }
 
 func SetSignalExit(exitFunc func()) {
-	var s = make(chan os.Signal)
+	var s = make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGCONT)
 	go signalProcess(s, exitFunc)
 }
@@ -90,3 +93,64 @@ func isNum(pid string) int {
 	p, _ := strconv.Atoi(pid)
 	return p
 }
+
+// Start the command in a new session, so it leads its own process group
+// and the whole tree can be signalled later.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+}
+
+// Ask the process tree started by SetProcessGroup to hang up.
+func Hangup(p *os.Process) {
+	signalTree(p.Pid, syscall.SIGHUP)
+}
+
+// Kill the process tree started by SetProcessGroup.
+func KillTree(p *os.Process) {
+	signalTree(p.Pid, syscall.SIGKILL)
+}
+
+// Signal the process group and every process left in the session,
+// shell jobs get process groups of their own.
+func signalTree(sid int, sig syscall.Signal) {
+	syscall.Kill(-sid, sig)
+	for _, pid := range seachSession("/proc", sid) {
+		syscall.Kill(pid, sig)
+	}
+}
+
+func seachSession(srcPath string, sid int) (pids []int) {
+	dir, err := os.Open(srcPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(0)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		pid := isNum(name)
+		if pid == 0 {
+			continue
+		}
+		stat, err := ioutil.ReadFile(path.Join(srcPath, name, "stat"))
+		if err != nil {
+			continue
+		}
+		// comm may contain spaces, fields start after the last ')'
+		i := strings.LastIndexByte(string(stat), ')')
+		if i < 0 {
+			continue
+		}
+		// state ppid pgrp session ...
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) > 3 && isNum(fields[3]) == sid {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
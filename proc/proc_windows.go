@@ -3,6 +3,7 @@ package proc
 import (
 	"fmt"
 	"os"
+	"os/exec"
 )
 
 func Setuid(b bool) {
@@ -14,3 +15,14 @@ func SetSignalExit(exitFunc func()) {
 func SendExitSignal() {
 	fmt.Fprintf(os.Stderr, "Not yet supported.\n")
 }
+
+func SetProcessGroup(cmd *exec.Cmd) {
+}
+
+func Hangup(p *os.Process) {
+	p.Kill()
+}
+
+func KillTree(p *os.Process) {
+	p.Kill()
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Chroot jails and namespaces for session processes.
+
+package proc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where and how a session process is confined.
+type Sandbox struct {
+	Root       string   // chroot directory, "" for none
+	Namespaces []string // any of mount, pid, ipc, uts, net
+	Uid, Gid   int      // what a root daemon drops to inside the chroot
+}
+
+// Credentials of "nobody", the default inside a chroot.
+const NobodyId = 65534
+
+var (
+	ErrTooManyLinks = errors.New("Too many levels of symbolic links.")
+	ErrOutsideRoot  = errors.New("Path is outside the chroot.")
+)
+
+// Resolve a client supplied path inside root, following symlinks as if
+// root were "/", so the result never leaves root. The jail may change
+// after this returns, so open the result with OpenInRoot.
+func SecurePath(root, unsafe string) (string, error) {
+	path := "/"
+	links := 0
+	for unsafe != "" {
+		var part string
+		if i := strings.IndexByte(unsafe, '/'); i >= 0 {
+			part, unsafe = unsafe[:i], unsafe[i+1:]
+		} else {
+			part, unsafe = unsafe, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			path = filepath.Dir(path)
+			continue
+		}
+		next := filepath.Join(path, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			path = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", ErrTooManyLinks
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			path = "/"
+		}
+		unsafe = dest + "/" + unsafe
+	}
+	return filepath.Join(root, path), nil
+}
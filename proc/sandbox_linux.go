@@ -0,0 +1,300 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var namespaceFlags = map[string]uintptr{
+	"mount": syscall.CLONE_NEWNS,
+	"pid":   syscall.CLONE_NEWPID,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+	"net":   syscall.CLONE_NEWNET,
+}
+
+// Devices bound into the jail when it has its own mount namespace.
+var jailDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// Start cmd in new namespaces and, through the exec wrapper, in the jail.
+// A minimal /dev and a fresh /proc are set up when the mount namespace is
+// new, so nothing leaks into the host's mount table.
+func ApplySandbox(cmd *exec.Cmd, sb *Sandbox) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	mounts := false
+	for _, ns := range sb.Namespaces {
+		flag, ok := namespaceFlags[ns]
+		if !ok {
+			return fmt.Errorf("unknown namespace %q", ns)
+		}
+		cmd.SysProcAttr.Cloneflags |= flag
+		if ns == "mount" {
+			mounts = true
+		}
+	}
+	if sb.Root != "" {
+		root, err := filepath.Abs(sb.Root)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			return fmt.Errorf("chroot %s is not a directory", root)
+		}
+		wrap(cmd, "root="+root)
+		if mounts {
+			wrap(cmd, "mounts")
+		}
+		// Root can walk out of a chroot, so never stay root in one.
+		if os.Geteuid() == 0 {
+			wrap(cmd, "uid="+strconv.Itoa(sb.Uid)+":"+strconv.Itoa(sb.Gid))
+		}
+	}
+	return nil
+}
+
+// Runs in the wrapper: populate the jail and chroot into it.
+func enterRoot(root string, mounts bool) error {
+	if mounts {
+		if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("private mounts: %v", err)
+		}
+		dev := filepath.Join(root, "dev")
+		os.MkdirAll(dev, 0755)
+		for _, name := range jailDevices {
+			target := filepath.Join(dev, name)
+			if fp, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0666); err == nil {
+				fp.Close()
+			}
+			if err := unix.Mount(filepath.Join("/dev", name), target, "", unix.MS_BIND, ""); err != nil {
+				return fmt.Errorf("bind %s: %v", name, err)
+			}
+		}
+		pts := filepath.Join(dev, "pts")
+		os.MkdirAll(pts, 0755)
+		unix.Mount("/dev/pts", pts, "", unix.MS_BIND, "")
+		proc := filepath.Join(root, "proc")
+		os.MkdirAll(proc, 0555)
+		if err := unix.Mount("proc", proc, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("mount proc: %v", err)
+		}
+	}
+	if err := unix.Chroot(root); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+// Runs in the wrapper after the chroot: give up root for good. The other
+// threads still hold it, but exec follows right after and drops them.
+func dropRoot(ids string) error {
+	var uid, gid int
+	if _, err := fmt.Sscanf(ids, "%d:%d", &uid, &gid); err != nil {
+		return fmt.Errorf("bad uid option %q", ids)
+	}
+	if uid == 0 {
+		return fmt.Errorf("refusing to run as root in a chroot")
+	}
+	if err := unix.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := unix.Setresgid(gid, gid, gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := unix.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	return nil
+}
+
+// Run f on a thread of its own with the file system identity of uid and
+// gid, so file access from the daemon gets that user's permissions. The
+// thread exits with the goroutine, it never goes back to the runtime.
+func AsUser(uid, gid int, f func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		// Raw calls, these must only change this thread.
+		if _, _, e := unix.RawSyscall(unix.SYS_SETGROUPS, 0, 0, 0); e != 0 {
+			errc <- fmt.Errorf("setgroups: %v", e)
+			return
+		}
+		unix.RawSyscall(unix.SYS_SETFSGID, uintptr(gid), 0, 0)
+		unix.RawSyscall(unix.SYS_SETFSUID, uintptr(uid), 0, 0)
+		// Both return the old id, ask again with an invalid one.
+		fsgid, _, _ := unix.RawSyscall(unix.SYS_SETFSGID, ^uintptr(0), 0, 0)
+		fsuid, _, _ := unix.RawSyscall(unix.SYS_SETFSUID, ^uintptr(0), 0, 0)
+		if int(fsuid) != uid || int(fsgid) != gid {
+			errc <- fmt.Errorf("unable to act as %d:%d", uid, gid)
+			return
+		}
+		errc <- f()
+	}()
+	return <-errc
+}
+
+// Open a path made by SecurePath one component at a time from root,
+// refusing symlinks, so one swapped in after the lookup can't lead out.
+func OpenInRoot(root, path string, flag int, perm os.FileMode) (*os.File, error) {
+	dir, name, err := openParent(root, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	fd, err := unix.Openat(dir, name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Stat a path made by SecurePath without following symlinks on the way.
+func StatInRoot(root, path string) (os.FileInfo, error) {
+	fp, err := OpenInRoot(root, path, unix.O_PATH, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return fp.Stat()
+}
+
+func MkdirInRoot(root, path string, perm os.FileMode) error {
+	dir, name, err := openParent(root, path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := unix.Mkdirat(dir, name, uint32(perm)); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+func RemoveInRoot(root, path string) error {
+	dir, name, err := openParent(root, path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := unix.Unlinkat(dir, name, 0); err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Connect to the socket at a path made by SecurePath, refusing symlinks
+// on the way and in its place.
+func DialInRoot(root, path string) (net.Conn, error) {
+	dir, name, err := openParent(root, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	fd, err := unix.Openat(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFSOCK {
+		return nil, &os.PathError{Op: "dial", Path: path, Err: unix.ECONNREFUSED}
+	}
+	// The descriptor's /proc link leads to that very socket.
+	return net.Dial("unix", fdPath(fd))
+}
+
+// Listen on a socket at a path made by SecurePath, bound and linked into
+// place through descriptors like OpenInRoot. As with a plain bind, the
+// path must not exist, and the socket never has other permissions than
+// mode: it is bound in a private directory first.
+func ListenInRoot(root, path string, mode os.FileMode) (net.Listener, error) {
+	dir, name, err := openParent(root, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	tmpName := ".sshdog" + hex.EncodeToString(buf[:])
+	if err := unix.Mkdirat(dir, tmpName, 0700); err != nil {
+		return nil, &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	defer unix.Unlinkat(dir, tmpName, unix.AT_REMOVEDIR)
+	tmp, err := unix.Openat(dir, tmpName, unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(tmp)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: fdPath(tmp) + "/s", Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The name it was bound to goes away with the directory.
+	listener.SetUnlinkOnClose(false)
+	defer unix.Unlinkat(tmp, "s", 0)
+	if err = unix.Fchmodat(tmp, "s", uint32(mode), 0); err == nil {
+		err = unix.Linkat(tmp, "s", dir, name, 0)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, &os.PathError{Op: "bind", Path: path, Err: err}
+	}
+	return listener, nil
+}
+
+func fdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// The directory holding path, opened without following symlinks, and
+// the last component of path.
+func openParent(root, path string) (int, string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return -1, "", ErrOutsideRoot
+	}
+	dir, err := unix.Open(root, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(dir, part, unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		unix.Close(dir)
+		if err != nil {
+			return -1, "", &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		dir = next
+	}
+	return dir, parts[len(parts)-1], nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// Refuse to run rather than run unconfined.
+func ApplySandbox(cmd *exec.Cmd, sb *Sandbox) error {
+	return errors.New("Sandboxed sessions are not supported.")
+}
+
+// Nothing to switch to without sandboxes.
+func AsUser(uid, gid int, f func() error) error {
+	return f()
+}
+
+// Sandboxes never start here, so a chroot is only a path prefix.
+func OpenInRoot(root, path string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+func StatInRoot(root, path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func MkdirInRoot(root, path string, perm os.FileMode) error {
+	return os.Mkdir(path, perm)
+}
+
+func RemoveInRoot(root, path string) error {
+	return os.Remove(path)
+}
+
+func DialInRoot(root, path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
+
+func ListenInRoot(root, path string, mode os.FileMode) (net.Listener, error) {
+	return nil, errors.New("Unix sockets in a chroot are not supported.")
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Go has no hook to run code between fork and exec, so session setup that
+// must happen in the child is done by re-running this binary as a small
+// wrapper: it applies its options, then execs the real command.
+//
+//	sshd __sshdog_exec [option...] -- path argv...
+
+package proc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	wrapperArg  = "__sshdog_exec"
+	wrapperPath = "/proc/self/exe"
+)
+
+// Make cmd start through the wrapper and add opt to its options.
+func wrap(cmd *exec.Cmd, opt string) {
+	if cmd.Path != wrapperPath || len(cmd.Args) < 2 || cmd.Args[1] != wrapperArg {
+		args := []string{os.Args[0], wrapperArg, "--", cmd.Path}
+		cmd.Args = append(args, cmd.Args...)
+		cmd.Path = wrapperPath
+	}
+	for i, arg := range cmd.Args {
+		if arg == "--" {
+			args := append([]string{}, cmd.Args[:i]...)
+			args = append(args, opt)
+			cmd.Args = append(args, cmd.Args[i:]...)
+			return
+		}
+	}
+}
+
+// Run as the wrapper when started through wrap, returns otherwise.
+func WrapperMain() {
+	if len(os.Args) < 2 || os.Args[1] != wrapperArg {
+		return
+	}
+	// nice, ionice and namespaces belong to the thread that will exec.
+	runtime.LockOSThread()
+	err := runWrapper(os.Args[2:])
+	fmt.Fprintf(os.Stderr, "sshdog: %v\n", err)
+	os.Exit(126)
+}
+
+func runWrapper(args []string) error {
+	var root, ids string
+	var mounts bool
+	enter := 0
+	for len(args) > 0 && args[0] != "--" {
+		opt := args[0]
+		args = args[1:]
+		name, value := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			name, value = opt[:i], opt[i+1:]
+		}
+		switch name {
+		case "limits":
+			l, err := decodeLimits(value)
+			if err != nil {
+				return err
+			}
+			if err := l.apply(); err != nil {
+				return err
+			}
+		case "cgroup":
+			if err := joinCgroup(value); err != nil {
+				return err
+			}
+		case "root":
+			root = value
+		case "mounts":
+			mounts = true
+		case "uid":
+			ids = value
+		case "enter":
+			pid, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			enter = pid
+		default:
+			return fmt.Errorf("unknown wrapper option %q", opt)
+		}
+	}
+	if len(args) < 3 {
+		return fmt.Errorf("wrapper: missing command")
+	}
+	path, argv := args[1], args[2:]
+
+	if root != "" {
+		if err := enterRoot(root, mounts); err != nil {
+			return err
+		}
+		// The path was looked up outside the jail.
+		if !strings.Contains(argv[0], "/") {
+			if p, err := exec.LookPath(argv[0]); err == nil {
+				path = p
+			}
+		}
+		home := os.Getenv("HOME")
+		if fi, err := os.Stat(home); home == "" || err != nil || !fi.IsDir() {
+			home = "/"
+		}
+		if err := os.Chdir(home); err != nil {
+			return err
+		}
+		if ids != "" {
+			if err := dropRoot(ids); err != nil {
+				return err
+			}
+		}
+	}
+	if enter != 0 {
+		if err := enterProcess(enter); err != nil {
+			return err
+		}
+		if p, err := exec.LookPath(argv[0]); err == nil {
+			path = p
+		}
+		if err := os.Chdir(os.Getenv("HOME")); err != nil {
+			os.Chdir("/")
+		}
+		return forkAndWait(path, argv)
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+func joinCgroup(dir string) error {
+	return writeFile(filepath.Join(dir, "cgroup.procs"), "0")
+}
+
+func writeFile(name, data string) error {
+	fp, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = fp.WriteString(data)
+	return err
+}
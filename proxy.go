@@ -0,0 +1,233 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Upstream SOCKS5 and HTTP CONNECT proxies for forwarded connections,
+// selected with proxy=socks5://[user:pass@]host:port or
+// proxy=http://[user:pass@]host:port in the `outbound` file.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrProxyScheme  = errors.New("Proxy must be socks5:// or http://.")
+	ErrProxyNetwork = errors.New("Only TCP goes through a proxy.")
+)
+
+type upstreamProxy struct {
+	scheme string
+	addr   string
+	user   *url.Userinfo
+}
+
+// Error reported by the proxy, used as the reject message.
+type proxyError struct {
+	proxy  string
+	reason string
+}
+
+func (e *proxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %s", e.proxy, e.reason)
+}
+
+func parseProxy(s string) (*upstreamProxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, ErrProxyScheme
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "socks5" {
+			addr = net.JoinHostPort(u.Hostname(), "1080")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "8080")
+		}
+	}
+	return &upstreamProxy{scheme: u.Scheme, addr: addr, user: u.User}, nil
+}
+
+// Connect to target through the proxy, reaching the proxy with dial.
+// timeout bounds the handshake as well, 0 for none.
+func (p *upstreamProxy) Dial(dial func(network, address string) (net.Conn, error), target string, timeout time.Duration) (net.Conn, error) {
+	c, err := dial("tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if p.scheme == "socks5" {
+		err = p.socks5(c, target)
+	} else {
+		c, err = p.connect(c, target)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+var socks5Replies = []string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// RFC 1928 CONNECT, with RFC 1929 username/password when configured.
+func (p *upstreamProxy) socks5(c net.Conn, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(0)
+	if p.user != nil {
+		method = 2
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return &proxyError{p.addr, "no acceptable authentication method"}
+	}
+	if method == 2 {
+		user := p.user.Username()
+		pass, _ := p.user.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return &proxyError{p.addr, "credentials too long"}
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return &proxyError{p.addr, "authentication failed"}
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return &proxyError{p.addr, "host name too long"}
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		reason := "error " + strconv.Itoa(int(head[1]))
+		if int(head[1]) < len(socks5Replies) {
+			reason = socks5Replies[head[1]]
+		}
+		return &proxyError{p.addr, reason}
+	}
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(c, n); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return &proxyError{p.addr, "bad reply"}
+	}
+	bound := make([]byte, skip+2)
+	_, err = io.ReadFull(c, bound)
+	return err
+}
+
+// HTTP CONNECT. The returned conn keeps whatever the proxy sent after
+// its response.
+func (p *upstreamProxy) connect(c net.Conn, target string) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if p.user != nil {
+		pass, _ := p.user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(p.user.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	if _, err := io.WriteString(c, req+"\r\n"); err != nil {
+		return c, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return c, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return c, &proxyError{p.addr, resp.Status}
+	}
+	return &bufferedConn{c, br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
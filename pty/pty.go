@@ -19,13 +19,26 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
 type Pty struct {
-	pty *os.File
-	tty *os.File
+	pty    *os.File
+	tty    *os.File
+	name   string
+	output chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	owner   chan []byte // to the writer given to AttachIO
+	outputs []io.Writer
+	ask     chan byte
 }
 
+// Queue depth of the owner's writer, in pty reads.
+const ownerQueueLen = 64
+
 type ptyWindow struct {
 	rows uint16
 	cols uint16
@@ -34,11 +47,16 @@ type ptyWindow struct {
 }
 
 func OpenPty() (*Pty, error) {
-	pty, tty, err := open_pty()
+	pty, tty, name, err := open_pty()
 	if err != nil {
 		return nil, err
 	}
-	return &Pty{pty, tty}, nil
+	return &Pty{pty: pty, tty: tty, name: name}, nil
+}
+
+// Name of the slave device, e.g. /dev/pts/3
+func (pty *Pty) Name() string {
+	return pty.name
 }
 
 func (pty *Pty) CloseTTY() {
@@ -59,10 +77,12 @@ func (pty *Pty) AttachTty(cmd *exec.Cmd) {
 	attach_tty(pty.tty, cmd)
 }
 
-// Close the devices
+// Close the devices, this also stops the AttachIO copies.
 func (pty *Pty) Close() {
-	pty.tty.Close()
-	pty.pty.Close()
+	pty.once.Do(func() {
+		pty.tty.Close()
+		pty.pty.Close()
+	})
 }
 
 // Resize the pty
@@ -74,6 +94,152 @@ func (pty *Pty) Resize(rows, cols, xpix, ypix uint16) error {
 // Attach to IO
 func (pty *Pty) AttachIO(w io.Writer, r io.Reader) {
 	//teardown session
-	go io.Copy(pty.pty, r)
-	go io.Copy(w, pty.pty)
+	owner := make(chan []byte, ownerQueueLen)
+	pty.mu.Lock()
+	pty.owner = owner
+	pty.mu.Unlock()
+	pty.output = make(chan struct{})
+	if r != nil {
+		go io.Copy(pty, r)
+	}
+	failed := make(chan struct{})
+	go func() {
+		pty.writeOwner(w, owner, failed)
+		close(pty.output)
+	}()
+	go pty.copyOutput(owner, failed)
+}
+
+// Write the owner's queue to w. A slow owner holds up the copy, as
+// without the queue, but not Notice, Ask or the added outputs.
+func (pty *Pty) writeOwner(w io.Writer, owner <-chan []byte, failed chan<- struct{}) {
+	for b := range owner {
+		if _, err := w.Write(b); err != nil {
+			close(failed)
+			for range owner {
+			}
+			return
+		}
+	}
+}
+
+// Copy the master to every added output and the owner's queue.
+func (pty *Pty) copyOutput(owner chan<- []byte, failed <-chan struct{}) {
+	defer func() {
+		pty.mu.Lock()
+		close(owner)
+		pty.owner = nil
+		pty.mu.Unlock()
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := pty.pty.Read(buf)
+		if n > 0 {
+			b := append([]byte(nil), buf[:n]...)
+			pty.mu.Lock()
+			outputs := pty.outputs
+			pty.mu.Unlock()
+			for _, out := range outputs {
+				out.Write(b)
+			}
+			select {
+			case owner <- b:
+			case <-failed:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write input to the pty, for callers feeding it without AttachIO.
+// A pending Ask takes the first byte.
+func (pty *Pty) Write(b []byte) (int, error) {
+	pty.mu.Lock()
+	ask := pty.ask
+	pty.ask = nil
+	pty.mu.Unlock()
+	if ask != nil && len(b) > 0 {
+		ask <- b[0]
+		if _, err := pty.pty.Write(b[1:]); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return pty.pty.Write(b)
+}
+
+// Write input that doesn't come from the session owner.
+func (pty *Pty) Inject(b []byte) (int, error) {
+	return pty.pty.Write(b)
+}
+
+// Copy output of the master to w as well, until RemoveOutput. w is
+// written from the copy loop and must not block, queue it if it may.
+func (pty *Pty) AddOutput(w io.Writer) {
+	pty.mu.Lock()
+	pty.outputs = append(pty.outputs, w)
+	pty.mu.Unlock()
+}
+
+// The copy loop may still be writing a slice taken before, so the list
+// is replaced, never changed in place.
+func (pty *Pty) RemoveOutput(w io.Writer) {
+	pty.mu.Lock()
+	outputs := make([]io.Writer, 0, len(pty.outputs))
+	for _, out := range pty.outputs {
+		if out != w {
+			outputs = append(outputs, out)
+		}
+	}
+	pty.outputs = outputs
+	pty.mu.Unlock()
+}
+
+// Show a message to the owner only, the writer given to AttachIO. It is
+// dropped when the owner has fallen so far behind that its queue is full.
+func (pty *Pty) Notice(msg string) {
+	pty.mu.Lock()
+	if pty.owner != nil {
+		select {
+		case pty.owner <- []byte(msg):
+		default:
+		}
+	}
+	pty.mu.Unlock()
+}
+
+// Show a question to the owner and hand their next keystroke to the
+// returned channel instead of the pty. CancelAsk withdraws it.
+func (pty *Pty) Ask(msg string) <-chan byte {
+	c := make(chan byte, 1)
+	pty.mu.Lock()
+	pty.ask = c
+	pty.mu.Unlock()
+	pty.Notice(msg)
+	return c
+}
+
+func (pty *Pty) CancelAsk(c <-chan byte) {
+	pty.mu.Lock()
+	if pty.ask == c {
+		pty.ask = nil
+	}
+	pty.mu.Unlock()
+}
+
+// Wait for the output copy to drain after the process is gone.
+// Returns false on timeout.
+func (pty *Pty) WaitIO(timeout time.Duration) bool {
+	if pty.output == nil {
+		return true
+	}
+	select {
+	case <-pty.output:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
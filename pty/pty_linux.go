@@ -48,10 +48,10 @@ func unlockpt(pty *os.File) error {
 	return nil
 }
 
-func open_pty() (p, t *os.File, err error) {
+func open_pty() (p, t *os.File, sname string, err error) {
 	p, err = posix_openpt(os.O_RDWR | unix.O_NOCTTY)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 	// In case of error after this point, make sure we close the ptmx fd.
 	defer func() {
@@ -60,20 +60,20 @@ func open_pty() (p, t *os.File, err error) {
 		}
 	}()
 
-	sname, err := ptsname(p)
+	sname, err = ptsname(p)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	if err := unlockpt(p); err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	t, err = os.OpenFile(sname, os.O_RDWR|syscall.O_NOCTTY, 0)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
-	return p, t, nil
+	return p, t, sname, nil
 }
 
 func resize_pty(pty *os.File, size *ptyWindow) error {
@@ -90,6 +90,14 @@ func attach_tty(tty *os.File, cmd *exec.Cmd) error {
 	}
 	cmd.SysProcAttr.Setsid = true
 	cmd.SysProcAttr.Setctty = true
-	cmd.SysProcAttr.Ctty = int(tty.Fd())
+	// Ctty is a descriptor number in the child, not in this process.
+	for fd, f := range []interface{}{cmd.Stdin, cmd.Stdout, cmd.Stderr} {
+		if f == tty {
+			cmd.SysProcAttr.Ctty = fd
+			return nil
+		}
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, tty)
+	cmd.SysProcAttr.Ctty = 2 + len(cmd.ExtraFiles)
 	return nil
 }
@@ -25,8 +25,8 @@ import (
 
 var Unsupported = errors.New("Unsupported platform")
 
-func open_pty() (pty, tty *os.File, err error) {
-	return nil, nil, Unsupported
+func open_pty() (pty, tty *os.File, name string, err error) {
+	return nil, nil, "", Unsupported
 }
 
 func attach_tty(_ *os.File, _ *exec.Cmd) error {
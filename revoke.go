@@ -0,0 +1,336 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The `revoked_keys` file, public keys one per line or an OpenSSH KRL
+// from ssh-keygen -k (see PROTOCOL.krl). It is read again whenever it
+// changes, and a file that can't be parsed revokes every key.
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyRevoked = errors.New("Key revoked.")
+	ErrBadKRL     = errors.New("Bad key revocation list.")
+)
+
+const (
+	krlMagic = "SSHKRL\n\x00"
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignatures        = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+	krlCertExtension    = 0x39
+)
+
+type revocationList struct {
+	keys   map[string]bool // key blobs
+	sha1   map[string]bool // raw fingerprints
+	sha256 map[string]bool
+	certs  []*revokedCerts
+}
+
+// Certificates revoked under one CA, any CA if ca is empty.
+type revokedCerts struct {
+	ca      []byte
+	serials []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]bool
+}
+
+type serialRange struct {
+	min, max uint64
+}
+
+type serialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+var revokedLock sync.Mutex
+var revokedList *revocationList
+var revokedErr error
+var revokedMtime time.Time
+var revokedSize int64 = -1
+
+// The current list, nil without a `revoked_keys` file.
+func loadRevokedKeys() (*revocationList, error) {
+	path := conf.getPath("revoked_keys")
+	fi, err := os.Stat(path)
+	revokedLock.Lock()
+	defer revokedLock.Unlock()
+	if os.IsNotExist(err) {
+		revokedList, revokedErr, revokedSize = nil, nil, -1
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.ModTime().Equal(revokedMtime) && fi.Size() == revokedSize {
+		return revokedList, revokedErr
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		revokedList, revokedErr = parseKRL(data[len(krlMagic):])
+	} else {
+		revokedList, revokedErr = parseRevokedKeys(data)
+	}
+	if revokedErr != nil {
+		dbg.Debug("Unable to parse revoked_keys: %v", revokedErr)
+	} else {
+		dbg.Debug("Loaded revoked_keys.")
+	}
+	revokedMtime, revokedSize = fi.ModTime(), fi.Size()
+	return revokedList, revokedErr
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+func parseRevokedKeys(data []byte) (*revocationList, error) {
+	l := newRevocationList()
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		l.keys[string(key.Marshal())] = true
+		data = rest
+	}
+	return l, nil
+}
+
+// Take a string off the front of data.
+func krlString(data []byte) ([]byte, []byte, error) {
+	var s struct {
+		S    []byte
+		Rest []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &s); err != nil {
+		return nil, nil, ErrBadKRL
+	}
+	return s.S, s.Rest, nil
+}
+
+func krlUint64(data []byte) (uint64, []byte, error) {
+	var s struct {
+		N    uint64
+		Rest []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &s); err != nil {
+		return 0, nil, ErrBadKRL
+	}
+	return s.N, s.Rest, nil
+}
+
+func parseKRL(data []byte) (*revocationList, error) {
+	var header struct {
+		FormatVersion uint32
+		KRLVersion    uint64
+		GeneratedDate uint64
+		Flags         uint64
+		Reserved      []byte
+		Comment       []byte
+		Rest          []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &header); err != nil || header.FormatVersion != 1 {
+		return nil, ErrBadKRL
+	}
+	l := newRevocationList()
+	data = header.Rest
+	for len(data) > 0 {
+		kind := data[0]
+		section, rest, err := krlString(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		// Not one string like the others: the key, then the signature.
+		if kind == krlSectionSignatures {
+			if _, data, err = krlString(data); err != nil {
+				return nil, err
+			}
+			continue // OpenSSH doesn't check it either
+		}
+		var into map[string]bool
+		switch kind {
+		case krlSectionCertificates:
+			certs, err := parseKRLCerts(section)
+			if err != nil {
+				return nil, err
+			}
+			l.certs = append(l.certs, certs)
+			continue
+		case krlSectionExplicitKey:
+			into = l.keys
+		case krlSectionFingerprintSHA1:
+			into = l.sha1
+		case krlSectionFingerprintSHA256:
+			into = l.sha256
+		default:
+			return nil, ErrBadKRL
+		}
+		for len(section) > 0 {
+			var item []byte
+			if item, section, err = krlString(section); err != nil {
+				return nil, err
+			}
+			into[string(item)] = true
+		}
+	}
+	return l, nil
+}
+
+func parseKRLCerts(data []byte) (*revokedCerts, error) {
+	ca, data, err := krlString(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, data, err = krlString(data); err != nil { // reserved
+		return nil, err
+	}
+	c := &revokedCerts{ca: ca, keyIDs: make(map[string]bool)}
+	for len(data) > 0 {
+		kind := data[0]
+		var section []byte
+		if section, data, err = krlString(data[1:]); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case krlCertSerialList:
+			for len(section) > 0 {
+				var serial uint64
+				if serial, section, err = krlUint64(section); err != nil {
+					return nil, err
+				}
+				c.serials = append(c.serials, serialRange{serial, serial})
+			}
+		case krlCertSerialRange:
+			var r serialRange
+			if r.min, section, err = krlUint64(section); err != nil {
+				return nil, err
+			}
+			if r.max, section, err = krlUint64(section); err != nil {
+				return nil, err
+			}
+			c.serials = append(c.serials, r)
+		case krlCertSerialBitmap:
+			var b struct {
+				Offset uint64
+				Bits   *big.Int
+			}
+			if err := ssh.Unmarshal(section, &b); err != nil {
+				return nil, ErrBadKRL
+			}
+			c.bitmaps = append(c.bitmaps, serialBitmap{b.Offset, b.Bits})
+		case krlCertKeyID:
+			for len(section) > 0 {
+				var id []byte
+				if id, section, err = krlString(section); err != nil {
+					return nil, err
+				}
+				c.keyIDs[string(id)] = true
+			}
+		case krlCertExtension:
+			// Revocation by extension, only ever optional so far.
+		default:
+			return nil, ErrBadKRL
+		}
+	}
+	return c, nil
+}
+
+// Whether the key, or for a certificate its key, CA or serial, is revoked.
+func (l *revocationList) isRevoked(key ssh.PublicKey) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if l.keyRevoked(cert.Key) || l.keyRevoked(cert.SignatureKey) {
+			return true
+		}
+		for _, c := range l.certs {
+			if c.revoked(cert) {
+				return true
+			}
+		}
+	}
+	return l.keyRevoked(key)
+}
+
+func (l *revocationList) keyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	h1 := sha1.Sum(blob)
+	h256 := sha256.Sum256(blob)
+	return l.keys[string(blob)] || l.sha1[string(h1[:])] || l.sha256[string(h256[:])]
+}
+
+func (c *revokedCerts) revoked(cert *ssh.Certificate) bool {
+	if len(c.ca) > 0 && !bytes.Equal(c.ca, cert.SignatureKey.Marshal()) {
+		return false
+	}
+	if c.keyIDs[cert.KeyId] {
+		return true
+	}
+	// Serial zero means none, only the key ID can revoke it.
+	if cert.Serial == 0 {
+		return false
+	}
+	for _, r := range c.serials {
+		if cert.Serial >= r.min && cert.Serial <= r.max {
+			return true
+		}
+	}
+	for _, b := range c.bitmaps {
+		if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bits.BitLen()) &&
+			b.bits.Bit(int(cert.Serial-b.offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the key against `revoked_keys`.
+func checkRevoked(key ssh.PublicKey) error {
+	l, err := loadRevokedKeys()
+	if err != nil {
+		return err
+	}
+	if l != nil && l.isRevoked(key) {
+		return ErrKeyRevoked
+	}
+	return nil
+}
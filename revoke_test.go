@@ -0,0 +1,155 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/krl is ssh-keygen -k -f krl -s krl_ca.pub krl_spec: key1 by
+// key, key2 by SHA256 and key4 by SHA1 fingerprint, certificates of the
+// CA by serial list, range, bitmap and key ID. key3 isn't revoked.
+func readTestKey(t *testing.T, name string) ssh.PublicKey {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func readTestKRL(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "krl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(krlMagic)) {
+		t.Fatal("testdata/krl is not a KRL")
+	}
+	return data[len(krlMagic):]
+}
+
+func checkTestKRL(t *testing.T, l *revocationList) {
+	ca := readTestKey(t, "krl_ca.pub")
+	key3 := readTestKey(t, "krl_key3.pub")
+	for _, k := range []struct {
+		name    string
+		revoked bool
+	}{
+		{"krl_key1.pub", true},
+		{"krl_key2.pub", true},
+		{"krl_key3.pub", false},
+		{"krl_key4.pub", true},
+	} {
+		if got := l.isRevoked(readTestKey(t, k.name)); got != k.revoked {
+			t.Errorf("%s: revoked %v, want %v", k.name, got, k.revoked)
+		}
+	}
+
+	cert := func(signer ssh.PublicKey, serial uint64, id string) *ssh.Certificate {
+		return &ssh.Certificate{Key: key3, SignatureKey: signer, Serial: serial, KeyId: id, CertType: ssh.UserCert}
+	}
+	for _, c := range []struct {
+		serial  uint64
+		id      string
+		revoked bool
+	}{
+		{100000, "", true}, // range
+		{150000, "", true},
+		{200000, "", true},
+		{99999, "", false},
+		{200001, "", false},
+		{5000000000, "", true}, // list
+		{9000000000, "", true},
+		{5000000001, "", false},
+		{1000, "", true}, // bitmap
+		{1004, "", true},
+		{1009, "", true},
+		{1001, "", false},
+		{1008, "", false},
+		{1010, "", false},
+		{1, "revoked-id", true},
+		{0, "revoked-id", true},
+		{1, "other-id", false},
+		{0, "", false},
+	} {
+		if got := l.isRevoked(cert(ca, c.serial, c.id)); got != c.revoked {
+			t.Errorf("serial %d id %q: revoked %v, want %v", c.serial, c.id, got, c.revoked)
+		}
+	}
+	if l.isRevoked(cert(key3, 1000, "revoked-id")) {
+		t.Errorf("revoked a certificate of another CA")
+	}
+	if !l.isRevoked(cert(readTestKey(t, "krl_key1.pub"), 1, "")) {
+		t.Errorf("accepted a certificate from a revoked CA key")
+	}
+}
+
+func TestParseKRL(t *testing.T) {
+	l, err := parseKRL(readTestKRL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestKRL(t, l)
+}
+
+// A signed KRL ends in a section holding a key and a signature.
+func TestParseSignedKRL(t *testing.T) {
+	sig := ssh.Marshal(struct{ Key, Signature []byte }{
+		readTestKey(t, "krl_ca.pub").Marshal(), []byte("signature"),
+	})
+	l, err := parseKRL(append(append(readTestKRL(t), krlSectionSignatures), sig...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestKRL(t, l)
+}
+
+func TestRevokedKeysFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshdog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(saved *config) { conf = saved }(conf)
+	conf = &config{dir: dir}
+	key1 := readTestKey(t, "krl_key1.pub")
+	key3 := readTestKey(t, "krl_key3.pub")
+	path := filepath.Join(dir, "revoked_keys")
+
+	if err := checkRevoked(key1); err != nil {
+		t.Errorf("without the file got %v", err)
+	}
+	ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(key1), 0600)
+	if err := checkRevoked(key1); err != ErrKeyRevoked {
+		t.Errorf("listed key got %v, want %v", err, ErrKeyRevoked)
+	}
+	if err := checkRevoked(key3); err != nil {
+		t.Errorf("unlisted key got %v", err)
+	}
+	// Anything unreadable refuses every key.
+	ioutil.WriteFile(path, []byte(krlMagic+"garbage"), 0600)
+	if err := checkRevoked(key3); err == nil {
+		t.Errorf("a broken KRL let a key in")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Per-user jails, see proc.Sandbox.
+package main
+
+import (
+	"errors"
+	"github.com/hengwu0/sshdog/proc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const enterEnv = "SSHDOG_ENTER"
+
+var (
+	ErrEnterNotAllowed = errors.New("Not allowed to enter that process.")
+	ErrEnterSandbox    = errors.New("A sandboxed user can't enter other namespaces.")
+)
+
+// The user's jail from the `chroot` and `namespaces` files, nil if none.
+// A daemon running as root drops to `chroot_user` ("uid[:gid]", nobody
+// by default) once inside the chroot.
+func (conn *ServerConn) sandbox() *proc.Sandbox {
+	sb := &proc.Sandbox{Uid: proc.NobodyId, Gid: proc.NobodyId}
+	if root, err := conf.getUserBytes(conn.authUser(), "chroot"); err == nil {
+		sb.Root = strings.TrimSpace(string(root))
+	}
+	if ids, err := conf.getUserBytes(conn.authUser(), "chroot_user"); err == nil {
+		f := strings.SplitN(strings.TrimSpace(string(ids)), ":", 2)
+		if uid, err := strconv.Atoi(f[0]); err == nil && uid > 0 {
+			sb.Uid, sb.Gid = uid, uid
+			if len(f) == 2 {
+				if gid, err := strconv.Atoi(f[1]); err == nil && gid > 0 {
+					sb.Gid = gid
+				}
+			}
+		}
+	}
+	if lines, err := conf.getUserLines(conn.authUser(), "namespaces"); err == nil {
+		for _, line := range lines {
+			sb.Namespaces = append(sb.Namespaces, strings.Fields(line)...)
+		}
+	}
+	if sb.Root == "" && len(sb.Namespaces) == 0 {
+		return nil
+	}
+	return sb
+}
+
+// The chroot SCP is confined to, "" for none.
+func (conn *ServerConn) scpRoot() string {
+	if sb := conn.sandbox(); sb != nil && sb.Root != "" {
+		if root, err := filepath.Abs(sb.Root); err == nil {
+			return root
+		}
+		return sb.Root
+	}
+	return ""
+}
+
+// Map a client path for SCP into the user's chroot. Relative paths start
+// at HOME inside the jail when it exists there, at its root otherwise.
+func (conn *ServerConn) scpPath(path string) (string, error) {
+	root := conn.scpRoot()
+	if root == "" {
+		return path, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		home := sessionHome()
+		if fi, err := os.Stat(filepath.Join(root, home)); home != "" && err == nil && fi.IsDir() {
+			path = home + "/" + path
+		}
+	}
+	return proc.SecurePath(root, path)
+}
+
+// Join a name received from the client onto a path made by scpPath.
+func (conn *ServerConn) scpJoin(dir, name string) (string, error) {
+	root := conn.scpRoot()
+	if root == "" {
+		return filepath.Join(dir, name), nil
+	}
+	rel, err := filepath.Rel(root, filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return proc.SecurePath(root, filepath.ToSlash(rel))
+}
+
+// Run a file operation in the chroot as `chroot_user`, like the
+// sessions there, instead of with the daemon's root permissions.
+func (conn *ServerConn) asChrootUser(f func() error) error {
+	sb := conn.sandbox()
+	if sb == nil || sb.Root == "" || os.Geteuid() != 0 {
+		return f()
+	}
+	return proc.AsUser(sb.Uid, sb.Gid, f)
+}
+
+// Open, stat, create and remove paths made by scpPath without following
+// symlinks that appeared in the jail after the lookup.
+func (conn *ServerConn) scpOpen(path string, flag int, perm os.FileMode) (fp *os.File, err error) {
+	root := conn.scpRoot()
+	if root == "" {
+		return os.OpenFile(path, flag, perm)
+	}
+	err = conn.asChrootUser(func() error {
+		fp, err = proc.OpenInRoot(root, path, flag, perm)
+		return err
+	})
+	return fp, err
+}
+
+func (conn *ServerConn) scpStat(path string) (fi os.FileInfo, err error) {
+	root := conn.scpRoot()
+	if root == "" {
+		return os.Stat(path)
+	}
+	err = conn.asChrootUser(func() error {
+		fi, err = proc.StatInRoot(root, path)
+		return err
+	})
+	return fi, err
+}
+
+func (conn *ServerConn) scpMkdir(path string, perm os.FileMode) error {
+	if root := conn.scpRoot(); root != "" {
+		return conn.asChrootUser(func() error { return proc.MkdirInRoot(root, path, perm) })
+	}
+	return os.Mkdir(path, perm)
+}
+
+func (conn *ServerConn) scpRemove(path string) error {
+	if root := conn.scpRoot(); root != "" {
+		return conn.asChrootUser(func() error { return proc.RemoveInRoot(root, path) })
+	}
+	return os.Remove(path)
+}
+
+// Process whose namespaces the session enters: the `enter` file, or the
+// SSHDOG_ENTER request variable when it matches a line of `enter_allowed`.
+// Either one names a pid or "cgroup:<path>". 0 for none. A requested pid
+// only matches patterns of digits and wildcards, and a requested cgroup
+// must be a clean absolute path.
+func (conn *ServerConn) enterTarget(requested string) (int, error) {
+	user := conn.authUser()
+	target := requested
+	if target != "" {
+		allowed := false
+		if target = cleanEnterTarget(target); target != "" {
+			if patterns, err := conf.getUserLines(user, "enter_allowed"); err == nil {
+				for _, pattern := range patterns {
+					if !strings.HasPrefix(target, "cgroup:") && !isPidPattern(pattern) {
+						continue
+					}
+					if wildcardMatch(pattern, target) {
+						allowed = true
+						break
+					}
+				}
+			}
+		}
+		if !allowed {
+			conn.audit("rejected %s=%s", enterEnv, requested)
+			return 0, ErrEnterNotAllowed
+		}
+	} else if data, err := conf.getUserBytes(user, "enter"); err == nil {
+		target = strings.TrimSpace(string(data))
+	}
+	if target == "" {
+		return 0, nil
+	}
+	if strings.HasPrefix(target, "cgroup:") {
+		return proc.CgroupPid(strings.TrimPrefix(target, "cgroup:"))
+	}
+	return strconv.Atoi(target)
+}
+
+// The requested target in canonical form, "" if it isn't a plain pid or
+// an absolute cgroup path without "..".
+func cleanEnterTarget(target string) string {
+	if strings.HasPrefix(target, "cgroup:") {
+		path := strings.TrimPrefix(target, "cgroup:")
+		for _, part := range strings.Split(path, "/") {
+			if part == ".." {
+				return ""
+			}
+		}
+		if !filepath.IsAbs(path) {
+			return ""
+		}
+		return "cgroup:" + filepath.Clean(path)
+	}
+	if !isPidPattern(target) || strings.ContainsAny(target, "*?") {
+		return ""
+	}
+	return target
+}
+
+// Digits and wildcards, with at least one digit.
+func isPidPattern(pattern string) bool {
+	digits := false
+	for _, c := range pattern {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c != '*' && c != '?':
+			return false
+		}
+	}
+	return digits
+}
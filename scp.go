@@ -21,9 +21,9 @@ import (
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -54,6 +54,7 @@ var (
 	ErrInvalidPieces  = errors.New("Invalid number of command pieces.")
 	ErrNotRegularFile = errors.New("Not a regular file.")
 	ErrNotDirectory   = errors.New("Not a directory.")
+	ErrInvalidName    = errors.New("Invalid file name.")
 )
 
 // Manage SCP operations in a built-in fashion
@@ -83,7 +84,12 @@ func (conn *ServerConn) SCPHandler(shellCmd []string, ch ssh.Channel) error {
 		}
 	}
 
-	var err error
+	path, err := conn.scpPath(path)
+	if err != nil {
+		scpSendError(ch, err)
+		ch.Close()
+		return err
+	}
 	if source {
 		err = conn.SCPSource(path, dirMode, recursive, ch)
 	} else {
@@ -103,7 +109,7 @@ func (conn *ServerConn) SCPHandler(shellCmd []string, ch ssh.Channel) error {
 
 // Handle the 'source' side of an SCP connection
 func (conn *ServerConn) SCPSource(path string, dirMode bool, recursive bool, ch ssh.Channel) error {
-	srcFileInfo, err := os.Stat(path)
+	srcFileInfo, err := conn.scpStat(path)
 	if err != nil {
 		return err
 	}
@@ -114,16 +120,16 @@ func (conn *ServerConn) SCPSource(path string, dirMode bool, recursive bool, ch
 	}
 	if recursive {
 		if srcFileInfo.IsDir() {
-			return SCPSendDir(path, nil, src, ch)
+			return conn.SCPSendDir(path, nil, src, ch)
 		}
 	}
-	return SCPSendFile(path, src, ch)
+	return conn.SCPSendFile(path, src, ch)
 }
 
 // Send a directory
-func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
+func (conn *ServerConn) SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
 	if fi == nil {
-		if statfi, err := os.Stat(path); err != nil {
+		if statfi, err := conn.scpStat(path); err != nil {
 			return err
 		} else {
 			fi = statfi
@@ -141,16 +147,16 @@ func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) e
 	}
 
 	// Children
-	if contents, err := ioutil.ReadDir(path); err != nil {
+	if contents, err := conn.scpReadDir(path); err != nil {
 		scpSendAck(dst, SCPFatal, err.Error())
 		return err
 	} else {
 		for _, child := range contents {
 			lpath := filepath.Join(path, child.Name())
 			if child.IsDir() {
-				SCPSendDir(lpath, child, src, dst)
+				conn.SCPSendDir(lpath, child, src, dst)
 			} else {
-				SCPSendFile2(lpath, child, src, dst)
+				conn.SCPSendFile2(lpath, child, src, dst)
 			}
 		}
 	}
@@ -166,22 +172,22 @@ func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) e
 }
 
 // Send a file
-func SCPSendFile(path string, src *bufio.Reader, dst io.Writer) error {
+func (conn *ServerConn) SCPSendFile(path string, src *bufio.Reader, dst io.Writer) error {
 	dbg.Debug("Preparing to send %s", path)
-	fi, err := os.Stat(path)
+	fi, err := conn.scpStat(path)
 	if err != nil {
 		return err
 	}
-	return SCPSendFile2(path, fi, src, dst)
+	return conn.SCPSendFile2(path, fi, src, dst)
 }
 
 // Actually send the file
-func SCPSendFile2(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
+func (conn *ServerConn) SCPSendFile2(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
 	if fi.Mode()&os.ModeType != 0 {
 		scpSendAck(dst, SCPFatal, ErrNotRegularFile.Error())
 		return ErrNotRegularFile
 	}
-	fp, err := os.Open(path)
+	fp, err := conn.scpOpen(path, os.O_RDONLY, 0)
 	if err != nil {
 		scpSendAck(dst, SCPFatal, err.Error())
 		return err
@@ -294,33 +300,37 @@ func (conn *ServerConn) SCPSink(path string, dirMode bool, ch ssh.Channel) (err
 			if err = scpSendAck(ch, 0, ""); err != nil {
 				return err
 			}
-			fpath := filepath.Join(path, parsed.Name)
-			err = receiveFile(fpath, parsed, readbuf)
+			var fpath string
+			if fpath, err = conn.scpJoin(path, parsed.Name); err != nil {
+				continue
+			}
+			err = conn.receiveFile(fpath, parsed, readbuf)
 		case SCPDir:
-			path = filepath.Join(path, parsed.Name)
-			if err = maybeMakeDir(path, parsed.Mode); err != nil {
+			var dpath string
+			if dpath, err = conn.scpJoin(path, parsed.Name); err != nil {
+				continue
+			}
+			if err = conn.maybeMakeDir(dpath, parsed.Mode); err != nil {
 				continue
 			}
-			err = conn.SCPSink(path, dirMode, ch)
-			path = filepath.Clean(filepath.Join(path, ".."))
+			err = conn.SCPSink(dpath, dirMode, ch)
 		case SCPEndDir:
 			return nil
 		case SCPTime:
 		}
 	}
-	return nil
 }
 
 // receive the single file from the scp stream
-func receiveFile(name string, cmd *SCPCommand, src io.Reader) error {
+func (conn *ServerConn) receiveFile(name string, cmd *SCPCommand, src io.Reader) error {
 	left := cmd.Length
-	os.Remove(name) // to rewrite
-	fp, err := os.Create(name)
+	conn.scpRemove(name) // to rewrite
+	fp, err := conn.scpOpen(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 	defer fp.Close()
-	if err := fp.Chmod(os.FileMode(cmd.Mode)); err != nil {
+	if err := conn.asChrootUser(func() error { return fp.Chmod(os.FileMode(cmd.Mode)) }); err != nil {
 		return err
 	}
 	// TODO: refactor to io.CopyN
@@ -350,9 +360,9 @@ func receiveFile(name string, cmd *SCPCommand, src io.Reader) error {
 }
 
 // Make a directory if it doesn't exist
-func maybeMakeDir(path string, mode int16) error {
-	if fi, err := os.Stat(path); err != nil {
-		if err := os.Mkdir(path, os.FileMode(mode)); err != nil {
+func (conn *ServerConn) maybeMakeDir(path string, mode int16) error {
+	if fi, err := conn.scpStat(path); err != nil {
+		if err := conn.scpMkdir(path, os.FileMode(mode)); err != nil {
 			return err
 		}
 		return nil
@@ -364,6 +374,24 @@ func maybeMakeDir(path string, mode int16) error {
 	}
 }
 
+// The entries of a directory sorted by name, like ioutil.ReadDir.
+func (conn *ServerConn) scpReadDir(path string) ([]os.FileInfo, error) {
+	fp, err := conn.scpOpen(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var list []os.FileInfo
+	if err := conn.asChrootUser(func() error {
+		list, err = fp.Readdir(-1)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
 // Read a command from the SCP channel
 func scpReadCommand(src *bufio.Reader) (string, error) {
 	buf, err := src.ReadBytes(byte('\n'))
@@ -396,6 +424,9 @@ func parseSCPCommand(cmd string) (*SCPCommand, error) {
 		}
 
 		c.Name = pieces[2]
+		if c.Name == "" || c.Name == "." || c.Name == ".." || strings.ContainsAny(c.Name, "/\x00") {
+			return ErrInvalidName
+		}
 		return nil
 	}
 
@@ -18,13 +18,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -35,6 +41,10 @@ type Server struct {
 	ServerConfig   ssh.ServerConfig
 	Socket         net.Listener
 	AuthorizedKeys map[string]bool
+	hostKeys       []ssh.Signer
+	nextKeys       []ssh.Signer // staged, announced but not used yet
+	hostKeyAlgos   []string
+	pubkeyAlgos    []string
 	stop           chan bool
 	done           chan bool
 }
@@ -42,10 +52,15 @@ type Server struct {
 var keyNames = []string{
 	"ssh_host_dsa_key",
 	"ssh_host_ecdsa_key",
+	"ssh_host_ed25519_key",
 	"ssh_host_rsa_key",
 	"id_rsa",
 }
 
+// Permissions extension naming the user authentication admitted, what
+// every per-user setting is looked up by.
+const userExtension = "user"
+
 type pwChain struct {
 	usr, passwd string
 }
@@ -54,6 +69,7 @@ func NewServer() *Server {
 	s := &Server{}
 	s.AuthorizedKeys = make(map[string]bool)
 	s.ServerConfig.PublicKeyCallback = s.VerifyPublicKey
+	s.ServerConfig.BannerCallback = s.banner
 	if conf.usrpasswd {
 		s.ServerConfig.PasswordCallback = s.VerifyPassword
 	}
@@ -88,9 +104,13 @@ func (s *Server) acceptChannel() <-chan net.Conn {
 			}
 			dbg.Debug("Accepted connection from: %s", conn.RemoteAddr())
 			if conn, ok := conn.(*net.TCPConn); ok {
-				conn.SetKeepAlive(true)
-				conn.SetKeepAlivePeriod(time.Minute)
-				dbg.Debug("Socket KeepAlive ervey minutes period.")
+				if period := conf.getInt("tcp_keepalive", 60); period > 0 {
+					conn.SetKeepAlive(true)
+					conn.SetKeepAlivePeriod(time.Duration(period) * time.Second)
+					dbg.Debug("Socket KeepAlive every %d seconds.", period)
+				} else {
+					conn.SetKeepAlive(false)
+				}
 			} else {
 				dbg.Debug("Can't KeepAlive socket!")
 			}
@@ -101,7 +121,8 @@ func (s *Server) acceptChannel() <-chan net.Conn {
 }
 
 func (s *Server) handleConn(conn net.Conn) {
-	sConn, err := NewServerConn(conn, s)
+	kc := &kexInitConn{Conn: conn}
+	sConn, err := NewServerConn(kc, s)
 	if err != nil {
 		if err == io.EOF {
 			dbg.Debug("Connection closed by remote host.")
@@ -111,6 +132,7 @@ func (s *Server) handleConn(conn net.Conn) {
 		return
 	}
 	dbg.Debug("Authenticated client from: %s", sConn.RemoteAddr())
+	sConn.audit("negotiated %s", kc.negotiated())
 
 	go sConn.HandleConn()
 }
@@ -140,7 +162,6 @@ func (s *Server) ServeLoop() error {
 			return nil
 		}
 	}
-	return nil
 }
 
 func (s *Server) ListenAndServe(port int16) {
@@ -178,22 +199,100 @@ func (s *Server) AddAuthorizedKeys(keyData []byte) {
 }
 
 func (s *Server) AddHostkey(keyData []byte) error {
-	key, err := ssh.ParsePrivateKey(keyData)
+	key, err := parseHostKey(keyData)
+	if err == nil {
+		if !contains(s.hostKeyAlgos, key.PublicKey().Type()) {
+			return ErrAlgorithm
+		}
+		s.addHostSigner(key)
+		return nil
+	}
+	return err
+}
+
+// Stage a key for rotation. Clients with UpdateHostKeys learn it from
+// hostkeys-00@openssh.com before it replaces the current one.
+func (s *Server) AddNextHostkey(keyData []byte) error {
+	key, err := parseHostKey(keyData)
 	if err == nil {
-		s.ServerConfig.AddHostKey(key)
+		if !contains(s.hostKeyAlgos, key.PublicKey().Type()) {
+			return ErrAlgorithm
+		}
+		s.nextKeys = append(s.nextKeys, key)
 		return nil
 	}
 	return err
 }
 
+// Add the key of a public key file, signing with the hostkey_agent.
+func (s *Server) AddAgentHostkey(pubData []byte) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return err
+	}
+	if !contains(s.hostKeyAlgos, pub.Type()) {
+		return ErrAlgorithm
+	}
+	key, err := newAgentSigner(hostKeyAgentSocket(), pub)
+	if err != nil {
+		return err
+	}
+	s.addHostSigner(key)
+	return nil
+}
+
+// Like ServerConfig.AddHostKey, a key replaces one of the same type.
+// The keys are kept for hostkeys-prove-00@openssh.com.
+func (s *Server) addHostSigner(key ssh.Signer) {
+	s.ServerConfig.AddHostKey(key)
+	for i, k := range s.hostKeys {
+		if k.PublicKey().Type() == key.PublicKey().Type() {
+			s.hostKeys[i] = key
+			return
+		}
+	}
+	s.hostKeys = append(s.hostKeys, key)
+}
+
 func (s *Server) VerifyPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 	conf.getPasswdUpdateMsg()
-	keyStr := string(key.Marshal())
-	if _, ok := s.AuthorizedKeys[keyStr]; !ok {
-		dbg.Debug("Key not found!")
+	if !contains(s.pubkeyAlgos, key.Type()) {
+		dbg.Debug("Key type %s not accepted.", key.Type())
+		return nil, ErrAlgorithm
+	}
+	if err := checkRevoked(key); err != nil {
+		auditConn(conn, "rejected publickey %s: %v", ssh.FingerprintSHA256(key), err)
+		return nil, err
+	}
+	if !s.keyAllowedFor(conn.User(), key) {
+		dbg.Debug("Key not found for %s!", conn.User())
 		return nil, fmt.Errorf("No valid key found.")
 	}
-	return &ssh.Permissions{}, nil
+	info := "publickey " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	return &ssh.Permissions{Extensions: map[string]string{"auth-info": info, userExtension: conn.User()}}, nil
+}
+
+// Keys in users/<name>/authorized_keys log in as that user only, the
+// global ones as any user without a users/<name>/ directory.
+func (s *Server) keyAllowedFor(user string, key ssh.PublicKey) bool {
+	if !conf.hasUserDir(user) {
+		return s.AuthorizedKeys[string(key.Marshal())]
+	}
+	keyData, err := conf.getBytes(path.Join("users", user, "authorized_keys"))
+	if err != nil {
+		return false
+	}
+	for len(keyData) > 0 {
+		userKey, _, _, left, err := ssh.ParseAuthorizedKey(keyData)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(userKey.Marshal(), key.Marshal()) {
+			return true
+		}
+		keyData = left
+	}
+	return false
 }
 
 func (s *Server) VerifyPassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
@@ -204,7 +303,7 @@ func (s *Server) VerifyPassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissio
 	pw := string(pass)
 	for _, v := range pws {
 		if v.usr == c.User() && v.passwd == pw {
-			return nil, nil
+			return &ssh.Permissions{Extensions: map[string]string{"auth-info": "password", userExtension: c.User()}}, nil
 		}
 	}
 	return nil, fmt.Errorf("password rejected for %q", c.User())
@@ -245,15 +344,39 @@ func readPasswd() (map[int]pwChain, error) {
 	return pw, nil
 }
 
+var ErrRandomHostkey = errors.New("No host key algorithm to generate a key for.")
+
+// Generate a key of the first type hostkey_algorithms allows.
 func (s *Server) RandomHostkey() error {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	var key crypto.Signer
+	var err error
+	for _, algo := range s.hostKeyAlgos {
+		switch algo {
+		case ssh.KeyAlgoED25519:
+			_, key, err = ed25519.GenerateKey(rand.Reader)
+		case ssh.KeyAlgoECDSA256:
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case ssh.KeyAlgoECDSA384:
+			key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case ssh.KeyAlgoECDSA521:
+			key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		case ssh.KeyAlgoRSA:
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+		default:
+			continue
+		}
+		break
+	}
 	if err != nil {
 		return err
 	}
+	if key == nil {
+		return ErrRandomHostkey
+	}
 	signer, err := ssh.NewSignerFromSigner(key)
 	if err != nil {
 		return err
 	}
-	s.ServerConfig.AddHostKey(signer)
+	s.addHostSigner(signer)
 	return nil
 }
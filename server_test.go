@@ -0,0 +1,116 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run cmd as user and return its output.
+func runAs(addr, user string, key ssh.Signer, cmd string) (string, error) {
+	client, err := dialTestServer(addr, user, key)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+	out, err := sess.Output(cmd)
+	return strings.TrimSpace(string(out)), err
+}
+
+func TestPerUserAuthorizedKeys(t *testing.T) {
+	s, globalKey := newTestServer(t)
+	defer os.RemoveAll(conf.dir)
+	addr := listenTestServer(t, s)
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	bobKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := filepath.Join(conf.dir, "users", "bob")
+	if err := os.MkdirAll(bob, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(bob, "authorized_keys"), ssh.MarshalAuthorizedKey(bobKey.PublicKey()), 0600)
+	ioutil.WriteFile(filepath.Join(bob, "force_command"), []byte("echo bob\n"), 0600)
+
+	for _, c := range []struct {
+		user  string
+		key   ssh.Signer
+		admit bool
+	}{
+		{"alice", globalKey, true}, // no users/alice, the global keys apply
+		{"bob", globalKey, false},  // would escape bob's force_command
+		{"bob", bobKey, true},
+		{"alice", bobKey, false}, // listed for bob only
+	} {
+		out, err := runAs(addr, c.user, c.key, "echo hello")
+		if !c.admit {
+			if err == nil {
+				t.Errorf("%s let in with the wrong key, ran %q", c.user, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.user, err)
+			continue
+		}
+		want := "hello"
+		if c.user == "bob" {
+			want = "bob"
+		}
+		if out != want {
+			t.Errorf("%s ran %q, want %q", c.user, out, want)
+		}
+	}
+}
+
+func TestRandomHostkey(t *testing.T) {
+	for _, c := range []struct {
+		algos []string
+		want  string
+	}{
+		{[]string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSA}, ssh.KeyAlgoED25519},
+		{[]string{ssh.KeyAlgoDSA, ssh.KeyAlgoECDSA384}, ssh.KeyAlgoECDSA384},
+		{[]string{ssh.KeyAlgoRSA}, ssh.KeyAlgoRSA},
+		{[]string{ssh.KeyAlgoDSA}, ""},
+	} {
+		s := &Server{hostKeyAlgos: c.algos}
+		err := s.RandomHostkey()
+		if c.want == "" {
+			if err != ErrRandomHostkey {
+				t.Errorf("%v: got %v, want %v", c.algos, err, ErrRandomHostkey)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.algos, err)
+		} else if got := s.hostKeys[0].PublicKey().Type(); got != c.want {
+			t.Errorf("%v: generated %s, want %s", c.algos, got, c.want)
+		}
+	}
+}
@@ -33,6 +33,107 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "filename:passwd\n")
 	fmt.Fprintf(os.Stderr, "    #format:\n")
 	fmt.Fprintf(os.Stderr, "     usr:passwd\n")
+	fmt.Fprintf(os.Stderr, "filename:kill_timeout\n")
+	fmt.Fprintf(os.Stderr, "    #seconds from SIGHUP to SIGKILL of a dropped session, default 5.\n")
+	fmt.Fprintf(os.Stderr, "filename:max_persistent\n")
+	fmt.Fprintf(os.Stderr, "    #detachable sessions per user, default 8.\n")
+	fmt.Fprintf(os.Stderr, "    #ssh -t host sshdog-attach <name>   start or resume a session\n")
+	fmt.Fprintf(os.Stderr, "    #ssh host sshdog-attach -l          list detached sessions\n")
+	fmt.Fprintf(os.Stderr, "filename:scrollback\n")
+	fmt.Fprintf(os.Stderr, "    #bytes replayed when resuming a session, default 65536.\n")
+	fmt.Fprintf(os.Stderr, "filename:watchers\n")
+	fmt.Fprintf(os.Stderr, "    #users allowed to watch pty sessions, one per line.\n")
+	fmt.Fprintf(os.Stderr, "    #ssh host sshdog-watch -l           list sessions\n")
+	fmt.Fprintf(os.Stderr, "    #ssh -t host sshdog-watch [-c] <id> watch, -c asks the owner for control\n")
+	fmt.Fprintf(os.Stderr, "filename:force_command\n")
+	fmt.Fprintf(os.Stderr, "    #run this instead, client command goes to SSH_ORIGINAL_COMMAND.\n")
+	fmt.Fprintf(os.Stderr, "filename:allowed_commands\n")
+	fmt.Fprintf(os.Stderr, "    #exec command patterns, one per line, '*' matches anything.\n")
+	fmt.Fprintf(os.Stderr, "filename:exec_direct\n")
+	fmt.Fprintf(os.Stderr, "    #run exec commands as argv without a shell.\n")
+	fmt.Fprintf(os.Stderr, "filename:command_policy\n")
+	fmt.Fprintf(os.Stderr, "    #program approving each request by exit status 0.\n")
+	fmt.Fprintf(os.Stderr, "    #rejections are written to audit.log.\n")
+	fmt.Fprintf(os.Stderr, "dirname:users/<user>\n")
+	fmt.Fprintf(os.Stderr, "    #per-user copies of the files above, override the global ones.\n")
+	fmt.Fprintf(os.Stderr, "filename:limits\n")
+	fmt.Fprintf(os.Stderr, "    #session process limits, format:\n")
+	fmt.Fprintf(os.Stderr, "     cpu 60 | as 512M | nofile 1024 | nproc 64\n")
+	fmt.Fprintf(os.Stderr, "     nice 10 | ionice 2 7\n")
+	fmt.Fprintf(os.Stderr, "     cgroup /sys/fs/cgroup/sshdog | memory.max 256M | pids.max 100\n")
+	fmt.Fprintf(os.Stderr, "filename:chroot\n")
+	fmt.Fprintf(os.Stderr, "    #jail directory for shell, exec and scp.\n")
+	fmt.Fprintf(os.Stderr, "filename:namespaces\n")
+	fmt.Fprintf(os.Stderr, "    #new namespaces for sessions: mount pid ipc uts net\n")
+	fmt.Fprintf(os.Stderr, "    #with mount, the jail gets a minimal /dev and its own /proc.\n")
+	fmt.Fprintf(os.Stderr, "filename:enter\n")
+	fmt.Fprintf(os.Stderr, "    #run sessions in the namespaces of a pid, or cgroup:<path>\n")
+	fmt.Fprintf(os.Stderr, "filename:enter_allowed\n")
+	fmt.Fprintf(os.Stderr, "    #patterns a client may request with SSHDOG_ENTER=<target>\n")
+	fmt.Fprintf(os.Stderr, "filename:no_agent_forwarding\n")
+	fmt.Fprintf(os.Stderr, "    #refuse ssh -A.\n")
+	fmt.Fprintf(os.Stderr, "filename:no_x11_forwarding\n")
+	fmt.Fprintf(os.Stderr, "    #refuse ssh -X.\n")
+	fmt.Fprintf(os.Stderr, "filename:x11_display_offset\n")
+	fmt.Fprintf(os.Stderr, "    #first X11 display number to use, default 10.\n")
+	fmt.Fprintf(os.Stderr, "filename:x11_use_unix\n")
+	fmt.Fprintf(os.Stderr, "    #listen on /tmp/.X11-unix/X<n> instead of localhost:6000+n.\n")
+	fmt.Fprintf(os.Stderr, "filename:no_streamlocal_forwarding\n")
+	fmt.Fprintf(os.Stderr, "    #refuse Unix socket forwarding, or only the directions listed: local remote.\n")
+	fmt.Fprintf(os.Stderr, "filename:streamlocal_bind_mask\n")
+	fmt.Fprintf(os.Stderr, "    #octal mask for sockets of ssh -R, default 0177.\n")
+	fmt.Fprintf(os.Stderr, "filename:streamlocal_bind_unlink\n")
+	fmt.Fprintf(os.Stderr, "    #replace a leftover socket when binding ssh -R.\n")
+	fmt.Fprintf(os.Stderr, "filename:permit_open\n")
+	fmt.Fprintf(os.Stderr, "    #[!]host:port per line for ssh -L, host may be a pattern, CIDR, loopback, linklocal or private.\n")
+	fmt.Fprintf(os.Stderr, "filename:permit_listen\n")
+	fmt.Fprintf(os.Stderr, "    #[!]host:port per line for ssh -R bind addresses.\n")
+	fmt.Fprintf(os.Stderr, "filename:gateway_ports\n")
+	fmt.Fprintf(os.Stderr, "    #no, yes or clientspecified, where ssh -R binds, default no (loopback).\n")
+	fmt.Fprintf(os.Stderr, "filename:outbound\n")
+	fmt.Fprintf(os.Stderr, "    #host:port netns=FILE device=IF source=IP timeout=SEC proxy=URL per line, for ssh -L connections.\n")
+	fmt.Fprintf(os.Stderr, "filename:dial_timeout\n")
+	fmt.Fprintf(os.Stderr, "    #seconds to wait for ssh -L connections, default 30.\n")
+	fmt.Fprintf(os.Stderr, "filename:forward_idle_timeout\n")
+	fmt.Fprintf(os.Stderr, "    #seconds without traffic before a forwarded connection is closed, default never.\n")
+	fmt.Fprintf(os.Stderr, "    #ssh host sshdog-tunnels            list forwarded connections\n")
+	fmt.Fprintf(os.Stderr, "    #UDP forwarding needs the sshdog-udp client, see cmd/sshdog-udp.\n")
+	fmt.Fprintf(os.Stderr, "filename:<hostkey>.next\n")
+	fmt.Fprintf(os.Stderr, "    #staged host key, e.g. ssh_host_ecdsa_key.next, announced to clients\n")
+	fmt.Fprintf(os.Stderr, "    #with UpdateHostKeys so that it can replace the current key later.\n")
+	fmt.Fprintf(os.Stderr, "filename:client_alive_interval\n")
+	fmt.Fprintf(os.Stderr, "    #seconds between keepalive requests to the client, default 60, 0 disables.\n")
+	fmt.Fprintf(os.Stderr, "filename:client_alive_count_max\n")
+	fmt.Fprintf(os.Stderr, "    #unanswered keepalives before disconnecting, default 3.\n")
+	fmt.Fprintf(os.Stderr, "filename:tcp_keepalive\n")
+	fmt.Fprintf(os.Stderr, "    #TCP keepalive period in seconds, default 60, 0 disables.\n")
+	fmt.Fprintf(os.Stderr, "filename:idle_timeout\n")
+	fmt.Fprintf(os.Stderr, "    #seconds without channel traffic before disconnecting, default never.\n")
+	fmt.Fprintf(os.Stderr, "filename:max_connection_time\n")
+	fmt.Fprintf(os.Stderr, "    #seconds a connection may last, default unlimited.\n")
+	fmt.Fprintf(os.Stderr, "filename:max_exec_time\n")
+	fmt.Fprintf(os.Stderr, "    #seconds an exec command may run, default unlimited.\n")
+	fmt.Fprintf(os.Stderr, "filename:timeout_warning\n")
+	fmt.Fprintf(os.Stderr, "    #seconds before a timeout that pty sessions are warned, default 60.\n")
+	fmt.Fprintf(os.Stderr, "filename:revoked_keys\n")
+	fmt.Fprintf(os.Stderr, "    #public keys or an ssh-keygen -k KRL refused at login, re-read when changed.\n")
+	fmt.Fprintf(os.Stderr, "filename:hostkey_passphrase\n")
+	fmt.Fprintf(os.Stderr, "    #passphrase of encrypted host keys, else $SSHDOG_HOSTKEY_PASSPHRASE or asked at start.\n")
+	fmt.Fprintf(os.Stderr, "filename:hostkey_agent\n")
+	fmt.Fprintf(os.Stderr, "    #ssh-agent socket, default $SSH_AUTH_SOCK, signing for <hostkey>.pub files.\n")
+	fmt.Fprintf(os.Stderr, "filename:ciphers kex_algorithms macs hostkey_algorithms pubkey_algorithms\n")
+	fmt.Fprintf(os.Stderr, "    #algorithm names replacing the hardened defaults, +name adds, -name removes; see -T.\n")
+	fmt.Fprintf(os.Stderr, "filename:banner\n")
+	fmt.Fprintf(os.Stderr, "    #shown before login, may use $hostname $remote $user $version $date.\n")
+	fmt.Fprintf(os.Stderr, "filename:motd\n")
+	fmt.Fprintf(os.Stderr, "    #shown when a shell starts, may also use $last_login from the `lastlog` file.\n")
+	fmt.Fprintf(os.Stderr, "filename:environment\n")
+	fmt.Fprintf(os.Stderr, "    #session environment, format:\n")
+	fmt.Fprintf(os.Stderr, "     NAME=value\n")
+	fmt.Fprintf(os.Stderr, "filename:accept_env\n")
+	fmt.Fprintf(os.Stderr, "    #client env patterns to accept, default: LANG LC_*\n")
+	fmt.Fprintf(os.Stderr, "filename:expose_auth_info\n")
+	fmt.Fprintf(os.Stderr, "    #write auth methods to the file in SSH_USER_AUTH.\n")
 	fmt.Fprintf(os.Stderr, "filename:authorized_keys\n")
 	fmt.Fprintf(os.Stderr, "    hostkey file names:\n")
 	fmt.Fprintf(os.Stderr, "        ssh_host_dsa_key\n")
@@ -42,18 +143,33 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "    if no key file, RandomHostkey() will auto run,\n")
 	fmt.Fprintf(os.Stderr, "    the key fingerprint will be changed everytime.\n")
 	fmt.Fprintf(os.Stderr, "usage2: %s <-s/e/stop/exit>\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "send kill signal to running sshd.\n\n")
+	fmt.Fprintf(os.Stderr, "send kill signal to running sshd.\n")
+	fmt.Fprintf(os.Stderr, "usage3: %s -T\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "print the effective algorithms.\n\n")
 	fmt.Fprintf(os.Stderr, "Any question, please contact 'hengwu0 <wu.heng@zte.com.cn>'.\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	os.Exit(2)
 }
 
 var conf *config
+var dumpConfig bool
+
+// Shown by the banner and motd $version, set with -ldflags "-X main.version=...".
+var version = "dev"
 
 func main() {
+	proc.WrapperMain()
 	flagParse()
 	conf = mustFindConfig("config")
+	if dumpConfig {
+		if err := dumpAlgorithms(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error in algorithm config: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
+	promptPassphrase()
 	if conf.shouldDaemon {
 		if err := daemon.Daemonize(daemonStart, dbg == true); err != nil {
 			fmt.Fprintf(os.Stderr, "Error daemonizing: %v", err)
@@ -72,6 +188,7 @@ func flagParse() {
 	flag.BoolVar(&exit, "stop", false, "exit sshd.")
 	flag.BoolVar(&exit, "e", false, "exit sshd.")
 	flag.BoolVar(&exit, "exit", false, "exit sshd.")
+	flag.BoolVar(&dumpConfig, "T", false, "print the effective algorithms and exit.")
 	flag.Usage = usage
 	flag.Parse()
 	if f := flag.Args(); len(f) != 0 {
@@ -89,22 +206,41 @@ func flagParse() {
 // Actually run the implementation of the daemon
 func daemonStart() (waitFunc func(), stopFunc func()) {
 	conf.changePWD()
+	loadPassphrase()
 	server := NewServer()
+	if err := server.configureAlgorithms(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error in algorithm config: %v\n", err)
+		os.Exit(1)
+	}
 
 	hasHostKeys := false
 	for _, keyName := range keyNames {
 		if keyData, err := conf.getBytes(keyName); err == nil {
 			dbg.Debug("Adding hostkey file: %s", keyName)
 			if err = server.AddHostkey(keyData); err != nil {
-				dbg.Debug("Error adding public key: %v", err)
+				fmt.Fprintf(os.Stderr, "Error adding hostkey %s: %v\n", keyName, err)
+			} else {
+				hasHostKeys = true
+			}
+		} else if pubData, err := conf.getBytes(keyName + ".pub"); err == nil && conf.fileExists("hostkey_agent") {
+			dbg.Debug("Adding hostkey from agent: %s.pub", keyName)
+			if err = server.AddAgentHostkey(pubData); err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding agent hostkey %s: %v\n", keyName, err)
+			} else {
+				hasHostKeys = true
+			}
+		}
+		if keyData, err := conf.getBytes(keyName + ".next"); err == nil {
+			dbg.Debug("Adding staged hostkey file: %s.next", keyName)
+			if err = server.AddNextHostkey(keyData); err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding staged hostkey %s: %v\n", keyName, err)
 			}
-			hasHostKeys = true
 		}
 	}
 	if !hasHostKeys {
 		if err := server.RandomHostkey(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error adding random hostkey: %v", err)
-			return
+			fmt.Fprintf(os.Stderr, "Error adding random hostkey: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
@@ -0,0 +1,297 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Unix domain socket forwarding, OpenSSH's streamlocal extensions.
+// direct-streamlocal@openssh.com channels are ssh -L to a socket,
+// streamlocal-forward@openssh.com requests are ssh -R to a socket.
+package main
+
+import (
+	"errors"
+	"github.com/hengwu0/sshdog/proc"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrStreamLocalDenied = errors.New("Unix socket forwarding not allowed.")
+	ErrStreamLocalInUse  = errors.New("Socket path already forwarded.")
+)
+
+// Payload of direct-streamlocal@openssh.com.
+type streamLocalMessage struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// Payload of streamlocal-forward@openssh.com and its cancel request.
+type streamLocalForwardRequest struct {
+	SocketPath string
+}
+
+// Payload of forwarded-streamlocal@openssh.com.
+type forwardedStreamLocalMessage struct {
+	SocketPath string
+	Reserved   string
+}
+
+// A socket listening for the client's ssh -R.
+type streamForward struct {
+	path     string // as requested by the client
+	local    string // after mapping into the user's chroot
+	listener net.Listener
+}
+
+// Whether the user may forward Unix sockets in the given direction,
+// "local" or "remote". An empty `no_streamlocal_forwarding` file refuses
+// both, otherwise it lists the directions refused.
+func (conn *ServerConn) streamLocalAllowed(direction string) bool {
+	data, err := conf.getUserBytes(conn.authUser(), "no_streamlocal_forwarding")
+	if err != nil {
+		return true
+	}
+	refused := strings.Fields(string(data))
+	if len(refused) == 0 {
+		return false
+	}
+	for _, r := range refused {
+		if r == direction {
+			return false
+		}
+	}
+	return true
+}
+
+func (conn *ServerConn) HandleStreamLocalChannel(wg *sync.WaitGroup, newChan ssh.NewChannel) {
+	defer wg.Done()
+	var msg streamLocalMessage
+	if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+		dbg.Debug("Unable to setup socket forwarding: %v", err)
+		newChan.Reject(ssh.ResourceShortage, "Error parsing message.")
+		return
+	}
+	dbg.Debug("Socket forwarding request: %s", msg.SocketPath)
+	if !conn.streamLocalAllowed("local") {
+		conn.audit("rejected direct-streamlocal to %s", msg.SocketPath)
+		newChan.Reject(ssh.Prohibited, ErrStreamLocalDenied.Error())
+		return
+	}
+	path, err := conn.scpPath(msg.SocketPath)
+	if err != nil {
+		newChan.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	outbound, err := conn.dialSocket(path)
+	if err != nil {
+		dbg.Debug("Unable to dial socket: %v", err)
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer outbound.Close()
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dbg.Debug("Unable to accept chan: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	conn.relay("direct-streamlocal", msg.SocketPath, ch, outbound)
+
+	dbg.Debug("Closing socket forwarding: %s", msg.SocketPath)
+}
+
+// Handle streamlocal-forward@openssh.com.
+func (conn *ServerConn) startStreamForward(payload []byte) error {
+	var req streamLocalForwardRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	if !conn.streamLocalAllowed("remote") {
+		conn.audit("rejected streamlocal-forward on %s", req.SocketPath)
+		return ErrStreamLocalDenied
+	}
+	local, err := conn.scpPath(req.SocketPath)
+	if err != nil {
+		return err
+	}
+
+	conn.fwdLock.Lock()
+	defer conn.fwdLock.Unlock()
+	if _, ok := conn.streamForwards[req.SocketPath]; ok {
+		return ErrStreamLocalInUse
+	}
+	// Like StreamLocalBindUnlink, a leftover socket is only replaced
+	// when asked to.
+	if conf.userFileExists(conn.authUser(), "streamlocal_bind_unlink") {
+		conn.removeSocket(local)
+	}
+	listener, err := conn.listenSocket(local, 0666&^streamLocalBindMask(conn.authUser()))
+	if err != nil {
+		return err
+	}
+	sf := &streamForward{path: req.SocketPath, local: local, listener: listener}
+	if conn.streamForwards == nil {
+		conn.streamForwards = make(map[string]*streamForward)
+	}
+	conn.streamForwards[req.SocketPath] = sf
+	dbg.Debug("Forwarding socket %s to the client.", local)
+	go sf.serve(conn)
+	return nil
+}
+
+// Permissions taken away from forwarded sockets, `streamlocal_bind_mask`
+// in octal, 0177 by default.
+func streamLocalBindMask(user string) os.FileMode {
+	if data, err := conf.getUserBytes(user, "streamlocal_bind_mask"); err == nil {
+		if mask, err := strconv.ParseUint(strings.TrimSpace(string(data)), 8, 32); err == nil {
+			return os.FileMode(mask) & 0777
+		}
+	}
+	return 0177
+}
+
+// Listen on a socket at path that never exists with other permissions
+// than mode: it is bound in a private directory next to path, then
+// linked into place, which fails like bind does when path exists.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".sshdog")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The name it was bound to goes away with dir.
+	listener.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err == nil {
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Dial, listen on and remove sockets at paths made by scpPath. In a
+// chroot the user can swap in symlinks at any time, so there it is done
+// through descriptors and as `chroot_user`, like the scp helpers.
+func (conn *ServerConn) dialSocket(path string) (c net.Conn, err error) {
+	root := conn.scpRoot()
+	if root == "" {
+		return net.Dial("unix", path)
+	}
+	err = conn.asChrootUser(func() error {
+		c, err = proc.DialInRoot(root, path)
+		return err
+	})
+	return c, err
+}
+
+func (conn *ServerConn) listenSocket(path string, mode os.FileMode) (l net.Listener, err error) {
+	root := conn.scpRoot()
+	if root == "" {
+		return listenUnix(path, mode)
+	}
+	err = conn.asChrootUser(func() error {
+		l, err = proc.ListenInRoot(root, path, mode)
+		return err
+	})
+	return l, err
+}
+
+// Remove path if it is a socket.
+func (conn *ServerConn) removeSocket(path string) {
+	root := conn.scpRoot()
+	if root == "" {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return
+	}
+	conn.asChrootUser(func() error {
+		fi, err := proc.StatInRoot(root, path)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			err = proc.RemoveInRoot(root, path)
+		}
+		return err
+	})
+}
+
+// Handle cancel-streamlocal-forward@openssh.com.
+func (conn *ServerConn) cancelStreamForward(payload []byte) error {
+	var req streamLocalForwardRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	conn.fwdLock.Lock()
+	sf, ok := conn.streamForwards[req.SocketPath]
+	delete(conn.streamForwards, req.SocketPath)
+	conn.fwdLock.Unlock()
+	if !ok {
+		return ErrStreamLocalDenied
+	}
+	conn.closeStreamForward(sf)
+	return nil
+}
+
+// Stop every socket forwarding of the connection.
+func (conn *ServerConn) closeStreamForwards() {
+	conn.fwdLock.Lock()
+	forwards := conn.streamForwards
+	conn.streamForwards = nil
+	conn.fwdLock.Unlock()
+	for _, sf := range forwards {
+		conn.closeStreamForward(sf)
+	}
+}
+
+func (sf *streamForward) serve(conn *ServerConn) {
+	for {
+		c, err := sf.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			msg := forwardedStreamLocalMessage{SocketPath: sf.path}
+			ch, reqs, err := conn.OpenChannel("forwarded-streamlocal@openssh.com", ssh.Marshal(&msg))
+			if err != nil {
+				dbg.Debug("Unable to open forwarded socket channel: %v", err)
+				return
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(reqs)
+			conn.relay("forwarded-streamlocal", sf.path, ch, c)
+		}(c)
+	}
+}
+
+// Stop listening and remove the socket so it doesn't go stale.
+func (conn *ServerConn) closeStreamForward(sf *streamForward) {
+	sf.listener.Close()
+	conn.removeSocket(sf.local)
+}
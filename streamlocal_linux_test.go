@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A directory anybody may use, so it works for chroot_user too.
+func publicDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sshdog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(dir, 0777)
+	return dir
+}
+
+// The jailed user swaps a directory of the jail for a symlink leading
+// out, and plants one in place of a socket, after the paths were checked.
+// Dialing, binding and unlinking must not follow either.
+func TestStreamLocalSymlinkSwap(t *testing.T) {
+	dir, jail, outside := publicDir(t), publicDir(t), publicDir(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(jail)
+	defer os.RemoveAll(outside)
+	defer func(saved *config) { conf = saved }(conf)
+	conf = &config{dir: dir}
+	ioutil.WriteFile(filepath.Join(dir, "chroot"), []byte(jail), 0600)
+	conn := &ServerConn{ServerConn: &ssh.ServerConn{Permissions: &ssh.Permissions{}}}
+
+	secret := filepath.Join(outside, "secret")
+	l, err := net.Listen("unix", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	os.Chmod(secret, 0666)
+
+	sub := filepath.Join(jail, "sub")
+	os.Mkdir(sub, 0777)
+	os.Chmod(sub, 0777)
+	viaDir, err := conn.scpPath("/sub/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindPath, err := conn.scpPath("/sub/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viaLink, err := conn.scpPath("/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(sub)
+	os.Symlink(outside, sub)
+	os.Symlink(secret, filepath.Join(jail, "secret"))
+
+	for _, path := range []string{viaDir, viaLink} {
+		if c, err := conn.dialSocket(path); err == nil {
+			c.Close()
+			t.Errorf("dialed %s through a symlink", path)
+		}
+		conn.removeSocket(path)
+	}
+	if _, err := os.Lstat(secret); err != nil {
+		t.Errorf("removed the socket outside the jail: %v", err)
+	}
+	if l, err := conn.listenSocket(bindPath, 0666); err == nil {
+		l.Close()
+		t.Errorf("listened through a symlinked directory")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "s")); err == nil {
+		t.Errorf("bound a socket outside the jail")
+	}
+
+	// Back to a directory, everything works.
+	os.Remove(sub)
+	os.Mkdir(sub, 0777)
+	os.Chmod(sub, 0777)
+	l, err = conn.listenSocket(bindPath, 0666)
+	if err != nil {
+		t.Fatalf("listen in the jail: %v", err)
+	}
+	defer l.Close()
+	c, err := conn.dialSocket(bindPath)
+	if err != nil {
+		t.Fatalf("dial in the jail: %v", err)
+	}
+	c.Close()
+	conn.removeSocket(bindPath)
+	if _, err := os.Lstat(bindPath); err == nil {
+		t.Errorf("socket in the jail not removed")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Relaying of forwarded connections.
+// Every tunnel is counted and listed by `exec sshdog-tunnels`, EOF is
+// passed on as a half-close in both directions, and tunnels without
+// traffic for `forward_idle_timeout` seconds are closed.
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tunnelsCmd = "sshdog-tunnels"
+
+type tunnel struct {
+	// Updated atomically, first for 64-bit alignment.
+	sent     int64 // to the client
+	received int64 // from the client
+	active   int64 // unix nanoseconds of the last traffic
+
+	id     int
+	user   string
+	from   string
+	kind   string
+	target string
+	start  time.Time
+}
+
+var tunnelLock sync.Mutex
+var tunnelNextID = 1
+var tunnels = make(map[int]*tunnel)
+
+// Relay between the channel and c until both sides are done, then close
+// both. kind is the channel type and target what it connects to.
+func (conn *ServerConn) relay(kind, target string, ch ssh.Channel, c net.Conn) {
+	t := &tunnel{
+		user:   conn.authUser(),
+		from:   conn.RemoteAddr().String(),
+		kind:   kind,
+		target: target,
+		start:  time.Now(),
+		active: time.Now().UnixNano(),
+	}
+	tunnelLock.Lock()
+	t.id = tunnelNextID
+	tunnelNextID++
+	tunnels[t.id] = t
+	tunnelLock.Unlock()
+
+	ch = conn.trackActivity(ch)
+	done := make(chan struct{})
+	if idle := conf.getInt("forward_idle_timeout", 0); idle > 0 {
+		go t.reapIdle(time.Duration(idle)*time.Second, done, ch, c)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.copy(c, ch, &t.received)
+		closeWrite(c)
+	}()
+	go func() {
+		defer wg.Done()
+		t.copy(ch, c, &t.sent)
+		ch.CloseWrite()
+	}()
+	wg.Wait()
+	close(done)
+	ch.Close()
+	c.Close()
+
+	tunnelLock.Lock()
+	delete(tunnels, t.id)
+	tunnelLock.Unlock()
+	conn.audit("%s to %s closed after %v, %d bytes received, %d sent",
+		kind, target, time.Since(t.start).Round(time.Second), atomic.LoadInt64(&t.received), atomic.LoadInt64(&t.sent))
+}
+
+func (t *tunnel) copy(w io.Writer, r io.Reader, count *int64) {
+	buf := make([]byte, 64*1024) // room for any datagram
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&t.active, time.Now().UnixNano())
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			atomic.AddInt64(count, int64(n))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Pass on EOF, closing connections that can't half-close like UDP.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
+
+func (t *tunnel) reapIdle(timeout time.Duration, done chan struct{}, ch ssh.Channel, c net.Conn) {
+	tick := time.NewTicker(timeout / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&t.active))) >= timeout {
+				dbg.Debug("Closing idle tunnel %d to %s.", t.id, t.target)
+				ch.Close()
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Print the active tunnels, those of every user to `watchers`.
+func (conn *ServerConn) listTunnels(w io.Writer) {
+	all := canWatch(conn.authUser())
+	tunnelLock.Lock()
+	list := make([]*tunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		if all || t.user == conn.authUser() {
+			list = append(list, t)
+		}
+	}
+	tunnelLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	for _, t := range list {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.active))).Round(time.Second)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\tstarted %s\tidle %v\t%d received\t%d sent\r\n",
+			t.id, t.user, t.from, t.kind, t.target, t.start.Format(time.RFC3339), idle,
+			atomic.LoadInt64(&t.received), atomic.LoadInt64(&t.sent))
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// UDP forwarding, see the datagram package and cmd/sshdog-udp.
+package main
+
+import (
+	"github.com/hengwu0/sshdog/datagram"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// A direct-udp@sshdog channel, one datagram per Read and Write.
+type datagramChannel struct {
+	ssh.Channel
+	r *datagram.Reader
+}
+
+func (c *datagramChannel) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *datagramChannel) Write(b []byte) (int, error) {
+	if err := datagram.Write(c.Channel, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *ServerConn) HandleUDPChannel(wg *sync.WaitGroup, newChan ssh.NewChannel) {
+	defer wg.Done()
+	var msg datagram.Message
+	if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+		dbg.Debug("Unable to setup UDP forwarding: %v", err)
+		newChan.Reject(ssh.ResourceShortage, "Error parsing message.")
+		return
+	}
+	dbg.Debug("UDP forwarding request: %v", msg)
+
+	ips, err := conn.permittedAddrs("permit_open", msg.Host, int(msg.Port), conn.lookupDest)
+	if err == ErrForwardDenied {
+		newChan.Reject(ssh.Prohibited, err.Error())
+		return
+	} else if err != nil || len(ips) == 0 {
+		dbg.Debug("Unable to resolve UDP forward: %v", err)
+		newChan.Reject(ssh.ConnectionFailed, "unknown host "+msg.Host)
+		return
+	}
+
+	outbound, err := conn.dialForward("udp", msg.Host, ips, int(msg.Port))
+	if err != nil {
+		dbg.Debug("Unable to dial UDP forward: %v", err)
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer outbound.Close()
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dbg.Debug("Unable to accept chan: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	target := net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port)))
+	conn.relay(datagram.ChannelType, target, &datagramChannel{ch, datagram.NewReader(ch)}, outbound)
+
+	dbg.Debug("Closing UDP forwarding: %v", msg)
+}
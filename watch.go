@@ -0,0 +1,262 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Read-only shadowing of pty sessions.
+// Users listed in the `watchers` file may run `exec sshdog-watch <id>` to
+// see another session's output, `-c` additionally asks the owner for control.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hengwu0/sshdog/pty"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const watchCmd = "sshdog-watch"
+
+var (
+	ErrWatchDenied  = errors.New("Not allowed to watch sessions.")
+	ErrWatchUnknown = errors.New("No such session.")
+)
+
+// A pty session that can be watched.
+type watchedSession struct {
+	id    int
+	user  string
+	from  string
+	pty   *pty.Pty
+	start time.Time
+
+	mu       sync.Mutex
+	watchers []watcher
+	control  *Channel
+	asking   bool // a control request waits for the owner
+}
+
+type watcher struct {
+	ch  *Channel
+	out *queuedWriter
+}
+
+var watchLock sync.Mutex
+var watchNextID = 1
+var watchSessions = make(map[int]*watchedSession)
+
+// Make a pty session watchable until unregister.
+func (conn *ServerConn) registerWatched(p *pty.Pty) *watchedSession {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	ws := &watchedSession{
+		id:    watchNextID,
+		user:  conn.authUser(),
+		from:  conn.RemoteAddr().String(),
+		pty:   p,
+		start: time.Now(),
+	}
+	watchNextID++
+	watchSessions[ws.id] = ws
+	return ws
+}
+
+// The session is gone, disconnect its watchers.
+func (ws *watchedSession) unregister() {
+	watchLock.Lock()
+	delete(watchSessions, ws.id)
+	watchLock.Unlock()
+
+	ws.mu.Lock()
+	watchers := ws.watchers
+	ws.watchers, ws.control = nil, nil
+	ws.mu.Unlock()
+	for _, w := range watchers {
+		ws.pty.RemoveOutput(w.out)
+		w.out.stop()
+		w.ch.Close()
+	}
+}
+
+func canWatch(user string) bool {
+	users, err := conf.getLines("watchers")
+	if err != nil {
+		return false
+	}
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the watchable sessions.
+func listWatched(w io.Writer) {
+	watchLock.Lock()
+	list := make([]*watchedSession, 0, len(watchSessions))
+	for _, ws := range watchSessions {
+		list = append(list, ws)
+	}
+	watchLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	for _, ws := range list {
+		ws.mu.Lock()
+		n := len(ws.watchers)
+		ws.mu.Unlock()
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\tstarted %s\t%d watching\r\n",
+			ws.id, ws.user, ws.from, ws.pty.Name(), ws.start.Format(time.RFC3339), n)
+	}
+}
+
+// Handle `sshdog-watch [-l] [-c] <id>` on the channel.
+func (conn *ServerConn) WatchHandler(cmd []string, ch *Channel) error {
+	if !canWatch(conn.authUser()) {
+		return ErrWatchDenied
+	}
+	control := false
+	id := 0
+	for _, opt := range cmd[1:] {
+		switch opt {
+		case "-l":
+		case "-c":
+			control = true
+		default:
+			if n, err := strconv.Atoi(opt); err == nil {
+				id = n
+			}
+		}
+	}
+	if id == 0 {
+		listWatched(ch.ch)
+		ch.Close()
+		return nil
+	}
+
+	watchLock.Lock()
+	ws, ok := watchSessions[id]
+	watchLock.Unlock()
+	if !ok {
+		return ErrWatchUnknown
+	}
+	who := conn.authUser() + "@" + conn.RemoteAddr().String()
+	// Output is copied on the owner's pty goroutine, a watcher that can't
+	// keep up is dropped rather than slowing the owner down.
+	out := newQueuedWriter(ch.ch, 0, func() {
+		dbg.Debug("Watcher %s too slow, dropped.", who)
+		ch.notify("\r\n[sshdog: dropped, not keeping up with the session]\r\n")
+		ch.Close()
+	})
+	ws.mu.Lock()
+	ws.watchers = append(ws.watchers, watcher{ch, out})
+	ws.mu.Unlock()
+	ch.watching = ws
+	ch.watcher = who
+	dbg.Debug("%s watching session %d, control %v.", who, id, control)
+	ws.pty.Notice(fmt.Sprintf("\r\n[sshdog: this session is being watched by %s]\r\n", who))
+	ws.pty.AddOutput(out)
+	go ws.input(ch)
+	if control {
+		go ws.askControl(ch, who)
+	}
+	return nil
+}
+
+// Ask the owner to hand control to the watcher, waiting for y/n. Only one
+// request may be pending at a time.
+func (ws *watchedSession) askControl(ch *Channel, who string) {
+	ws.mu.Lock()
+	if ws.asking {
+		ws.mu.Unlock()
+		ch.notify("\r\n[sshdog: another control request is pending, watching only]\r\n")
+		return
+	}
+	ws.asking = true
+	ws.mu.Unlock()
+
+	granted := false
+	c := ws.pty.Ask(fmt.Sprintf("\r\n[sshdog: %s requests control of this session, allow? (y/n)]\r\n", who))
+	select {
+	case b := <-c:
+		granted = b == 'y' || b == 'Y'
+	case <-time.After(30 * time.Second):
+		ws.pty.CancelAsk(c)
+	}
+
+	ws.mu.Lock()
+	ws.asking = false
+	if granted {
+		// The watcher may have left while the owner thought about it.
+		granted = false
+		for _, w := range ws.watchers {
+			if w.ch == ch {
+				ws.control, granted = ch, true
+			}
+		}
+	}
+	ws.mu.Unlock()
+	if !granted {
+		ws.pty.Notice("\r\n[sshdog: control refused]\r\n")
+		ch.notify("\r\n[sshdog: control refused, watching only]\r\n")
+		return
+	}
+	ws.pty.Notice(fmt.Sprintf("\r\n[sshdog: this session is now controlled by %s]\r\n", who))
+}
+
+// Read the watcher's keystrokes, passed on only while in control.
+func (ws *watchedSession) input(ch *Channel) {
+	rd := ch.ch
+	if rd == nil {
+		return
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := rd.Read(buf)
+		if n > 0 {
+			ws.mu.Lock()
+			control := ws.control == ch
+			ws.mu.Unlock()
+			if control {
+				ws.pty.Inject(buf[:n])
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Called when the watcher's channel goes away.
+func (ws *watchedSession) leave(ch *Channel) {
+	ws.mu.Lock()
+	var out *queuedWriter
+	for i, w := range ws.watchers {
+		if w.ch == ch {
+			ws.watchers = append(ws.watchers[:i], ws.watchers[i+1:]...)
+			out = w.out
+			break
+		}
+	}
+	if ws.control == ch {
+		ws.control = nil
+	}
+	ws.mu.Unlock()
+	if out != nil {
+		ws.pty.RemoveOutput(out)
+		out.stop()
+		ws.pty.Notice(fmt.Sprintf("\r\n[sshdog: %s stopped watching]\r\n", ch.watcher))
+	}
+}
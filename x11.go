@@ -0,0 +1,342 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// X11 forwarding (x11-req).
+// Like OpenSSH, the session gets a fake cookie; X clients present it to
+// our listener and it is swapped for the client's real cookie on the way
+// through the x11 channel.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	x11BasePort     = 6000
+	x11UnixDir      = "/tmp/.X11-unix"
+	x11MaxDisplays  = 1000
+	xauthFamilyWild = 65535
+)
+
+var (
+	ErrX11NoDisplay = errors.New("No free X11 display.")
+	ErrX11BadSetup  = errors.New("Bad X11 connection setup.")
+	ErrX11BadCookie = errors.New("X11 connection rejected because of wrong authentication.")
+	ErrXauthDir     = errors.New("Refusing to write an Xauthority file where others can write.")
+)
+
+type X11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+type x11Forward struct {
+	display   int
+	screen    uint32
+	listener  net.Listener
+	unixPath  string
+	proto     string
+	realData  []byte
+	fakeData  []byte
+	single    bool
+	xauthFile string
+	xauthEnv  []string
+	once      sync.Once
+}
+
+// Allocate a display for the session and start forwarding it.
+// env is the session environment, used for HOME and XAUTHORITY.
+func (conn *ServerConn) startX11Forward(req *X11Request, env []string) (*x11Forward, error) {
+	real, err := hex.DecodeString(req.AuthCookie)
+	if err != nil {
+		return nil, err
+	}
+	fake := make([]byte, len(real))
+	if _, err := rand.Read(fake); err != nil {
+		return nil, err
+	}
+	xf := &x11Forward{
+		screen:   req.ScreenNumber,
+		proto:    req.AuthProtocol,
+		realData: real,
+		fakeData: fake,
+		single:   req.SingleConnection,
+	}
+	useUnix := conf.userFileExists(conn.authUser(), "x11_use_unix")
+	for n := conf.getInt("x11_display_offset", 10); n < x11MaxDisplays; n++ {
+		if useUnix {
+			path := filepath.Join(x11UnixDir, "X"+strconv.Itoa(n))
+			if _, err := os.Lstat(path); err == nil {
+				continue
+			}
+			os.MkdirAll(x11UnixDir, 01777)
+			if l, err := net.Listen("unix", path); err == nil {
+				xf.listener, xf.unixPath = l, path
+			}
+		} else if l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", x11BasePort+n)); err == nil {
+			xf.listener = l
+		}
+		if xf.listener != nil {
+			xf.display = n
+			break
+		}
+	}
+	if xf.listener == nil {
+		return nil, ErrX11NoDisplay
+	}
+	if err := xf.writeXauth(env); err != nil {
+		xf.close()
+		return nil, err
+	}
+	go xf.serve(conn)
+	return xf, nil
+}
+
+// Value for DISPLAY.
+func (xf *x11Forward) displayName() string {
+	if xf.unixPath != "" {
+		return fmt.Sprintf("unix:%d.%d", xf.display, xf.screen)
+	}
+	return fmt.Sprintf("localhost:%d.%d", xf.display, xf.screen)
+}
+
+func (xf *x11Forward) serve(conn *ServerConn) {
+	for {
+		c, err := xf.listener.Accept()
+		if err != nil {
+			return
+		}
+		if xf.single {
+			xf.listener.Close()
+		}
+		go xf.forward(conn, c)
+		if xf.single {
+			return
+		}
+	}
+}
+
+func (xf *x11Forward) forward(conn *ServerConn, c net.Conn) {
+	defer c.Close()
+	setup, err := xf.readSetup(c)
+	if err != nil {
+		dbg.Debug("X11: %v", err)
+		return
+	}
+	origin := struct {
+		OriginatorAddress string
+		OriginatorPort    uint32
+	}{"127.0.0.1", 0}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		origin.OriginatorAddress = addr.IP.String()
+		origin.OriginatorPort = uint32(addr.Port)
+	}
+	ch, reqs, err := conn.OpenChannel("x11", ssh.Marshal(&origin))
+	if err != nil {
+		dbg.Debug("Unable to open x11 channel: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	if _, err := ch.Write(setup); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	io.Copy(c, ch)
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// Read the X11 connection setup and put the real cookie in place of the
+// fake one. Connections without the fake cookie are refused.
+func (xf *x11Forward) readSetup(r io.Reader) ([]byte, error) {
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch head[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, ErrX11BadSetup
+	}
+	nameLen := int(order.Uint16(head[6:]))
+	dataLen := int(order.Uint16(head[8:]))
+	rest := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	name := string(rest[:nameLen])
+	data := rest[pad4(nameLen) : pad4(nameLen)+dataLen]
+	if name != xf.proto || !bytes.Equal(data, xf.fakeData) {
+		return nil, ErrX11BadCookie
+	}
+	copy(data, xf.realData)
+	return append(head, rest...), nil
+}
+
+// Record the fake cookie for the display, through xauth when installed.
+func (xf *x11Forward) writeXauth(env []string) error {
+	display := xf.xauthDisplay()
+	if _, err := exec.LookPath("xauth"); err == nil {
+		xf.xauthEnv = env
+		return runXauth(env, fmt.Sprintf("remove %s\nadd %s %s %s\n",
+			display, display, xf.proto, hex.EncodeToString(xf.fakeData)))
+	}
+	file := getEnv(env, "XAUTHORITY")
+	if file == "" {
+		file = filepath.Join(getEnv(env, "HOME"), ".Xauthority")
+	}
+	xf.xauthFile = file
+	return updateXauthority(file, strconv.Itoa(xf.display), xf.proto, xf.fakeData)
+}
+
+func (xf *x11Forward) xauthDisplay() string {
+	if xf.unixPath != "" {
+		return fmt.Sprintf("unix:%d", xf.display)
+	}
+	return fmt.Sprintf("localhost:%d", xf.display)
+}
+
+func runXauth(env []string, commands string) error {
+	xauth := exec.Command("xauth", "-q", "-")
+	xauth.Env = env
+	xauth.Stdin = strings.NewReader(commands)
+	if out, err := xauth.CombinedOutput(); err != nil {
+		return fmt.Errorf("xauth: %v: %s", err, out)
+	}
+	return nil
+}
+
+// One entry of an .Xauthority file.
+type xauthEntry struct {
+	family uint16
+	fields [4][]byte // address, display number, name, data
+}
+
+// Replace the entry of display in file, data == nil only removes it.
+func updateXauthority(file, display, proto string, data []byte) error {
+	var entries []xauthEntry
+	if content, err := ioutil.ReadFile(file); err == nil {
+		entries = parseXauthority(content)
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if string(e.fields[1]) == display && (e.family == xauthFamilyWild || e.family == 256) {
+			continue
+		}
+		writeXauthEntry(&buf, e)
+	}
+	if data != nil {
+		writeXauthEntry(&buf, xauthEntry{
+			family: xauthFamilyWild,
+			fields: [4][]byte{nil, []byte(display), []byte(proto), data},
+		})
+	}
+	// Others could swap the file under us in a directory they can write.
+	dir := filepath.Dir(file)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&0022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return ErrXauthDir
+	}
+	// A fresh name created with O_EXCL, so a planted link isn't followed.
+	tmp, err := ioutil.TempFile(dir, filepath.Base(file)+".sshdog")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func parseXauthority(b []byte) []xauthEntry {
+	var entries []xauthEntry
+	for len(b) >= 2 {
+		e := xauthEntry{family: binary.BigEndian.Uint16(b)}
+		b = b[2:]
+		for i := range e.fields {
+			if len(b) < 2 {
+				return entries
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if len(b) < 2+n {
+				return entries
+			}
+			e.fields[i] = b[2 : 2+n]
+			b = b[2+n:]
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func writeXauthEntry(w *bytes.Buffer, e xauthEntry) {
+	binary.Write(w, binary.BigEndian, e.family)
+	for _, f := range e.fields {
+		binary.Write(w, binary.BigEndian, uint16(len(f)))
+		w.Write(f)
+	}
+}
+
+// Stop forwarding and forget the cookie.
+func (xf *x11Forward) close() {
+	xf.once.Do(func() {
+		xf.listener.Close()
+		if xf.unixPath != "" {
+			os.Remove(xf.unixPath)
+		}
+		if xf.xauthEnv != nil {
+			runXauth(xf.xauthEnv, "remove "+xf.xauthDisplay()+"\n")
+		}
+		if xf.xauthFile != "" {
+			updateXauthority(xf.xauthFile, strconv.Itoa(xf.display), "", nil)
+		}
+	})
+}